@@ -0,0 +1,96 @@
+package orangesys
+
+import (
+	"log"
+	"net/http"
+)
+
+// Authenticator adds credentials to the requests made by the HTTP client.
+type Authenticator interface {
+	// Authenticate decorates the request with credentials.
+	Authenticate(req *http.Request) error
+
+	// Unauthorized is called when the server rejected a request with 401.
+	// It returns true when the credentials have been refreshed and the
+	// request is worth retrying.
+	Unauthorized(resp *http.Response) bool
+}
+
+// TokenRefresher is implemented by token sources that can obtain a new
+// token after the server rejected the current one.
+type TokenRefresher interface {
+	Refresh() error
+}
+
+// BearerAuthenticator sends the token from a TokenSource in the
+// Authorization header.
+type BearerAuthenticator struct {
+	TokenSource TokenSource
+}
+
+// NewBearerAuthenticator returns an Authenticator for bearer tokens.
+func NewBearerAuthenticator(source TokenSource) *BearerAuthenticator {
+	return &BearerAuthenticator{TokenSource: source}
+}
+
+// Authenticate sets the Authorization header from the current token.  The
+// token is looked up on every request so a rotated token is used as soon
+// as it is available.
+func (a *BearerAuthenticator) Authenticate(req *http.Request) error {
+	token, err := a.TokenSource.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Unauthorized refreshes the token if the token source supports it.
+func (a *BearerAuthenticator) Unauthorized(resp *http.Response) bool {
+	refresher, ok := a.TokenSource.(TokenRefresher)
+	if !ok {
+		return false
+	}
+
+	if err := refresher.Refresh(); err != nil {
+		log.Printf("W! [outputs.orangesys] unable to refresh token: %v", err)
+		return false
+	}
+	return true
+}
+
+// BasicAuthenticator uses HTTP basic authentication.
+type BasicAuthenticator struct {
+	Username string
+	Password string
+}
+
+// NewBasicAuthenticator returns an Authenticator for HTTP basic auth.
+func NewBasicAuthenticator(username, password string) *BasicAuthenticator {
+	return &BasicAuthenticator{Username: username, Password: password}
+}
+
+// Authenticate sets the basic auth credentials on the request.
+func (a *BasicAuthenticator) Authenticate(req *http.Request) error {
+	req.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+// Unauthorized always returns false, static credentials can not be
+// refreshed.
+func (a *BasicAuthenticator) Unauthorized(resp *http.Response) bool {
+	return false
+}
+
+// NoAuthenticator sends requests without credentials.
+type NoAuthenticator struct{}
+
+// Authenticate leaves the request unchanged.
+func (NoAuthenticator) Authenticate(req *http.Request) error {
+	return nil
+}
+
+// Unauthorized always returns false.
+func (NoAuthenticator) Unauthorized(resp *http.Response) bool {
+	return false
+}
@@ -0,0 +1,177 @@
+package orangesys
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerSuccessThreshold = 1
+	defaultBreakerCooldown         = 30 * time.Second
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitOpenError is returned instead of writing to an endpoint whose
+// circuit breaker is open.
+type CircuitOpenError struct {
+	URL   string
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for [%s] is open until %s",
+		e.URL, e.Until.Format(time.RFC3339))
+}
+
+// circuitBreaker stops requests to an endpoint after consecutive failures.
+// Once the cool-down has passed it lets a single probe request through
+// (half-open), and closes again after enough probes succeed.
+type circuitBreaker struct {
+	failureThreshold int
+	successThreshold int
+	cooldown         time.Duration
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	successes int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(failureThreshold, successThreshold int, cooldown time.Duration) *circuitBreaker {
+	if successThreshold <= 0 {
+		successThreshold = defaultBreakerSuccessThreshold
+	}
+	return &circuitBreaker{
+		failureThreshold: failureThreshold,
+		successThreshold: successThreshold,
+		cooldown:         cooldown,
+	}
+}
+
+// Allow reports if a request may be sent.
+func (b *circuitBreaker) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.successes = 0
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records a request that reached the endpoint.  It returns true if
+// this closed the breaker.
+func (b *circuitBreaker) Success() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.state != breakerHalfOpen {
+		return false
+	}
+
+	b.probing = false
+	b.successes++
+	if b.successes < b.successThreshold {
+		return false
+	}
+	b.state = breakerClosed
+	return true
+}
+
+// Failure records a failed request.  It returns true if this opened the
+// breaker.
+func (b *circuitBreaker) Failure(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerOpen {
+		return false
+	}
+	if b.state != breakerHalfOpen && b.failures < b.failureThreshold {
+		return false
+	}
+
+	b.state = breakerOpen
+	b.openedAt = now
+	b.probing = false
+	return true
+}
+
+// OpenUntil returns when the cool-down of an open breaker ends.
+func (b *circuitBreaker) OpenUntil() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.openedAt.Add(b.cooldown)
+}
+
+// breakerClient wraps a Client with a circuit breaker.
+type breakerClient struct {
+	Client
+	breaker *circuitBreaker
+}
+
+// CreateDatabaseNamed creates the database with the wrapped client.
+func (c *breakerClient) CreateDatabaseNamed(ctx context.Context, database string) error {
+	return createDatabase(ctx, c.Client, database)
+}
+
+func (c *breakerClient) Write(ctx context.Context, metrics []telegraf.Metric) error {
+	if !c.breaker.Allow(time.Now()) {
+		return &CircuitOpenError{URL: c.URL(), Until: c.breaker.OpenUntil()}
+	}
+
+	err := c.Client.Write(ctx, metrics)
+	if err != nil && isEndpointFailure(err) {
+		if c.breaker.Failure(time.Now()) {
+			log.Printf("W! [outputs.orangesys] circuit breaker for [%s] opened for %s",
+				c.URL(), c.breaker.cooldown)
+		}
+		return err
+	}
+
+	if c.breaker.Success() {
+		log.Printf("I! [outputs.orangesys] circuit breaker for [%s] closed", c.URL())
+	}
+	return err
+}
+
+// isEndpointFailure reports if the error indicates that the endpoint is
+// unavailable, as opposed to the request being rejected.
+func isEndpointFailure(err error) bool {
+	if e, ok := err.(*APIError); ok && e.Type == DatabaseNotFound {
+		return false
+	}
+	return isRetryable(err)
+}
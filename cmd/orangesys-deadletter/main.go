@@ -0,0 +1,276 @@
+// Command orangesys-deadletter sends the metrics kept in the dead letter
+// files of the orangesys output again, for example after a field type
+// conflict has been resolved.
+//
+// Each file is removed once all of its metrics were written.  Files that
+// are still being appended to by a running Telegraf are best left alone,
+// use -skip-newest for that.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// record is a line of the JSON sidecar file written by the output.
+type record struct {
+	Time            time.Time `json:"time"`
+	Endpoint        string    `json:"endpoint"`
+	Database        string    `json:"database"`
+	RetentionPolicy string    `json:"retention_policy,omitempty"`
+	Status          int       `json:"status"`
+	Reason          string    `json:"reason"`
+	Measurement     string    `json:"measurement"`
+}
+
+var (
+	dir             = flag.String("dir", "", "dead letter directory (dead_letter_dir)")
+	serverURL       = flag.String("url", "", "URL of the server, defaults to the endpoint recorded for each metric")
+	database        = flag.String("database", "", "database to write to, defaults to the database recorded for each metric")
+	retentionPolicy = flag.String("retention-policy", "", "retention policy to write to, defaults to the retention policy recorded for each metric")
+	token           = flag.String("token", os.Getenv("ORANGESYS_TOKEN"), "jwt token, defaults to $ORANGESYS_TOKEN")
+	timeout         = flag.Duration("timeout", 30*time.Second, "timeout of each request")
+	skipNewest      = flag.Bool("skip-newest", false, "leave the newest file, which may still be written to")
+	dryRun          = flag.Bool("dry-run", false, "only print what would be sent")
+)
+
+func main() {
+	flag.Parse()
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "orangesys-deadletter: -dir is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "orangesys-deadletter: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	files, err := filepath.Glob(filepath.Join(*dir, "*.lp"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	if *skipNewest && len(files) > 0 {
+		files = files[:len(files)-1]
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	for _, file := range files {
+		n, err := resend(client, file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		if *dryRun {
+			continue
+		}
+
+		fmt.Printf("%s: sent %d metrics\n", file, n)
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		if err := os.Remove(sidecarPath(file)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func sidecarPath(file string) string {
+	return strings.TrimSuffix(file, ".lp") + ".json"
+}
+
+// target is where a group of metrics is written to.
+type target struct {
+	endpoint        string
+	database        string
+	retentionPolicy string
+}
+
+// resend writes the metrics of a file, grouped by the endpoint, database
+// and retention policy recorded in the sidecar.  When a group fails, the
+// file and sidecar are rewritten with the metrics not sent yet, so they
+// are not sent twice by the next run.
+func resend(client *http.Client, file string) (int, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	records, err := readRecords(sidecarPath(file))
+	if err != nil {
+		return 0, err
+	}
+
+	var order []target
+	groups := make(map[target]*bytes.Buffer)
+	targets := make([]target, len(lines))
+	for n, line := range lines {
+		var t target
+		if n < len(records) {
+			t = target{
+				endpoint:        records[n].Endpoint,
+				database:        records[n].Database,
+				retentionPolicy: records[n].RetentionPolicy,
+			}
+		}
+		if *serverURL != "" {
+			t.endpoint = *serverURL
+		}
+		if *database != "" {
+			t.database = *database
+		}
+		if *retentionPolicy != "" {
+			t.retentionPolicy = *retentionPolicy
+		}
+		if t.endpoint == "" {
+			return 0, fmt.Errorf("no endpoint recorded for line %d, use -url", n+1)
+		}
+		targets[n] = t
+
+		buf, ok := groups[t]
+		if !ok {
+			buf = &bytes.Buffer{}
+			groups[t] = buf
+			order = append(order, t)
+		}
+		buf.WriteString(line)
+	}
+
+	sent := make(map[target]bool, len(order))
+	for _, t := range order {
+		if *dryRun {
+			fmt.Printf("%s: would send %d bytes to [%s] database %q retention policy %q\n",
+				file, groups[t].Len(), t.endpoint, t.database, t.retentionPolicy)
+			continue
+		}
+		if err := write(client, t, groups[t].Bytes()); err != nil {
+			if len(sent) > 0 {
+				if err := keepUnsent(file, lines, records, targets, sent); err != nil {
+					return 0, err
+				}
+			}
+			return 0, err
+		}
+		sent[t] = true
+	}
+	return len(lines), nil
+}
+
+// keepUnsent rewrites the file and its sidecar with the lines of the
+// groups that were not sent.
+func keepUnsent(file string, lines []string, records []record, targets []target, sent map[target]bool) error {
+	var data, sidecar bytes.Buffer
+	enc := json.NewEncoder(&sidecar)
+	for n, line := range lines {
+		if sent[targets[n]] {
+			continue
+		}
+		data.WriteString(line)
+
+		var r record
+		if n < len(records) {
+			r = records[n]
+		}
+		if err := enc.Encode(&r); err != nil {
+			return err
+		}
+	}
+
+	if err := replaceFile(sidecarPath(file), sidecar.Bytes()); err != nil {
+		return err
+	}
+	return replaceFile(file, data.Bytes())
+}
+
+// replaceFile writes the data to a temporary file and renames it over the
+// file.
+func replaceFile(file string, data []byte) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func readRecords(path string) ([]record, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", path, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+func write(client *http.Client, t target, body []byte) error {
+	u, err := url.Parse(t.endpoint)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(u.Path, "write")
+
+	params := url.Values{}
+	if t.database != "" {
+		params.Set("db", t.database)
+	}
+	if t.retentionPolicy != "" {
+		params.Set("rp", t.retentionPolicy)
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "orangesys-deadletter")
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("writing to [%s] failed: %s: %s",
+		t.endpoint, resp.Status, strings.TrimSpace(string(msg)))
+}
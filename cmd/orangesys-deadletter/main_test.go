@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// deadLetterServer records the body of each write by its query and fails
+// the writes to the databases in fail.
+type deadLetterServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	fail   map[string]bool
+	writes map[string]string
+}
+
+func newDeadLetterServer(t *testing.T) *deadLetterServer {
+	s := &deadLetterServer{
+		fail:   map[string]bool{},
+		writes: map[string]string{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/write", r.URL.Path)
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.fail[r.URL.Query().Get("db")] {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.writes[r.URL.RawQuery] += string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return s
+}
+
+func writeDeadLetterFile(t *testing.T, endpoint string) string {
+	d, err := ioutil.TempDir("", "orangesys-deadletter")
+	require.NoError(t, err)
+
+	lines := strings.Join([]string{
+		"cpu value=1i 0",
+		"mem value=2i 0",
+		"cpu value=3i 0",
+		"disk value=4i 0",
+	}, "\n") + "\n"
+	records := strings.Join([]string{
+		`{"time":"2020-01-01T00:00:00Z","endpoint":"` + endpoint + `","database":"a","status":400,"reason":"field type conflict on cpu.value","measurement":"cpu"}`,
+		`{"time":"2020-01-01T00:00:00Z","endpoint":"` + endpoint + `","database":"b","retention_policy":"7d","status":400,"reason":"field type conflict on mem.value","measurement":"mem"}`,
+		`{"time":"2020-01-01T00:00:00Z","endpoint":"` + endpoint + `","database":"a","status":400,"reason":"field type conflict on cpu.value","measurement":"cpu"}`,
+		`{"time":"2020-01-01T00:00:00Z","endpoint":"` + endpoint + `","database":"c","status":400,"reason":"field type conflict on disk.value","measurement":"disk"}`,
+	}, "\n") + "\n"
+
+	file := filepath.Join(d, "00000000000000000000.lp")
+	require.NoError(t, ioutil.WriteFile(file, []byte(lines), 0600))
+	require.NoError(t, ioutil.WriteFile(sidecarPath(file), []byte(records), 0600))
+	return d
+}
+
+func listDir(t *testing.T, d string) []string {
+	files, err := filepath.Glob(filepath.Join(d, "*"))
+	require.NoError(t, err)
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRunResendsGroupsAndRemovesFiles(t *testing.T) {
+	ts := newDeadLetterServer(t)
+	defer ts.Close()
+
+	*dir = writeDeadLetterFile(t, ts.URL)
+	defer os.RemoveAll(*dir)
+
+	require.NoError(t, run())
+	require.Equal(t, map[string]string{
+		"db=a":       "cpu value=1i 0\ncpu value=3i 0\n",
+		"db=b&rp=7d": "mem value=2i 0\n",
+		"db=c":       "disk value=4i 0\n",
+	}, ts.writes)
+	require.Empty(t, listDir(t, *dir))
+}
+
+func TestRunKeepsOnlyUnsentGroupsAfterFailure(t *testing.T) {
+	ts := newDeadLetterServer(t)
+	defer ts.Close()
+
+	*dir = writeDeadLetterFile(t, ts.URL)
+	defer os.RemoveAll(*dir)
+
+	ts.fail["b"] = true
+	require.Error(t, run())
+	require.Equal(t, map[string]string{
+		"db=a": "cpu value=1i 0\ncpu value=3i 0\n",
+	}, ts.writes)
+	require.Equal(t, []string{"00000000000000000000.json", "00000000000000000000.lp"}, listDir(t, *dir))
+
+	ts.fail["b"] = false
+	require.NoError(t, run())
+	require.Equal(t, map[string]string{
+		"db=a":       "cpu value=1i 0\ncpu value=3i 0\n",
+		"db=b&rp=7d": "mem value=2i 0\n",
+		"db=c":       "disk value=4i 0\n",
+	}, ts.writes)
+	require.Empty(t, listDir(t, *dir))
+}
@@ -0,0 +1,185 @@
+package orangesys
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf/plugins/serializers/influx"
+)
+
+const (
+	defaultDeadLetterMaxFileSize = 10 << 20
+	defaultDeadLetterMaxFiles    = 10
+
+	deadLetterExt        = ".lp"
+	deadLetterSidecarExt = ".json"
+)
+
+// deadLetterRecord describes a rejected metric in the sidecar file, one
+// JSON object per line in the same order as the line protocol file.
+type deadLetterRecord struct {
+	Time            time.Time `json:"time"`
+	Endpoint        string    `json:"endpoint"`
+	Database        string    `json:"database"`
+	RetentionPolicy string    `json:"retention_policy,omitempty"`
+	Status          int       `json:"status"`
+	Reason          string    `json:"reason"`
+	Measurement     string    `json:"measurement"`
+}
+
+// deadLetterSink keeps the metrics rejected by the servers in rotating
+// files, so they can be sent again once the cause has been fixed.
+type deadLetterSink struct {
+	dir         string
+	maxFileSize int64
+	maxFiles    int
+	serializer  *influx.Serializer
+
+	mu    sync.Mutex
+	files []uint64
+	size  int64
+}
+
+func openDeadLetterSink(dir string, maxFileSize int64, maxFiles int, serializer *influx.Serializer) (*deadLetterSink, error) {
+	if maxFileSize <= 0 {
+		maxFileSize = defaultDeadLetterMaxFileSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultDeadLetterMaxFiles
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating dead_letter_dir: %v", err)
+	}
+
+	s := &deadLetterSink{
+		dir:         dir,
+		maxFileSize: maxFileSize,
+		maxFiles:    maxFiles,
+		serializer:  serializer,
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading dead_letter_dir: %v", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, deadLetterExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, deadLetterExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.files = append(s.files, seq)
+	}
+	sort.Slice(s.files, func(a, b int) bool {
+		return s.files[a] < s.files[b]
+	})
+
+	// Always start a new file, files of earlier runs may already be
+	// resent.
+	s.size = -1
+	return s, nil
+}
+
+func (s *deadLetterSink) path(seq uint64, ext string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, ext))
+}
+
+// Write appends the rejected metrics of the error to the current file.
+func (s *deadLetterSink) Write(c Client, e *PartialWriteError) error {
+	if len(e.Rejected) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	var lines, records bytes.Buffer
+	enc := json.NewEncoder(&records)
+	for _, r := range e.Rejected {
+		b, err := s.serializer.Serialize(r.Metric)
+		if err != nil {
+			continue
+		}
+		database := r.Database
+		if database == "" {
+			database = c.Database()
+		}
+		lines.Write(b)
+		err = enc.Encode(&deadLetterRecord{
+			Time:            now,
+			Endpoint:        e.URL,
+			Database:        database,
+			RetentionPolicy: r.RetentionPolicy,
+			Status:          e.StatusCode,
+			Reason:          r.Reason,
+			Measurement:     r.Metric.Name(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.size < 0 || s.size > 0 && s.size+int64(lines.Len()) > s.maxFileSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	seq := s.files[len(s.files)-1]
+	if err := appendFile(s.path(seq, deadLetterExt), lines.Bytes()); err != nil {
+		return err
+	}
+	if err := appendFile(s.path(seq, deadLetterSidecarExt), records.Bytes()); err != nil {
+		return err
+	}
+	s.size += int64(lines.Len())
+	return nil
+}
+
+// rotate starts a new file and removes the oldest files beyond the limit.
+func (s *deadLetterSink) rotate() error {
+	var seq uint64
+	if len(s.files) > 0 {
+		seq = s.files[len(s.files)-1] + 1
+	}
+	s.files = append(s.files, seq)
+	s.size = 0
+
+	for len(s.files) > s.maxFiles {
+		oldest := s.files[0]
+		for _, ext := range []string{deadLetterExt, deadLetterSidecarExt} {
+			if err := os.Remove(s.path(oldest, ext)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		s.files = s.files[1:]
+	}
+	return nil
+}
+
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,309 @@
+package orangesys
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSRVRefreshInterval = 30 * time.Second
+
+	srvSchemePrefix = "srv+"
+)
+
+// member is a client together with the state kept for it across
+// refreshes of the discovered endpoints.
+type member struct {
+	key      string
+	client   Client
+	weight   float64
+	priority int
+	stats    *endpointStats
+
+	// srvWeight is the weight of the SRV record the member was resolved
+	// from, 1 for other members.
+	srvWeight float64
+}
+
+func isSRVURL(u string) bool {
+	return strings.HasPrefix(u, srvSchemePrefix)
+}
+
+// lookupSRV resolves the SRV records of the name.
+func lookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	return addrs, err
+}
+
+// resolveSRV expands an endpoint with a srv+http or srv+https URL, such as
+// srv+https://_orangesys._tcp.example.com, into an endpoint for each SRV
+// record.  The endpoints are ordered by priority and weight and their
+// weight is taken from the record unless the endpoint sets one.  The
+// records are returned in the same order.
+func (i *Orangesys) resolveSRV(ctx context.Context, ep *Endpoint) ([]*Endpoint, []*net.SRV, error) {
+	u, err := url.Parse(ep.URL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing url [%s]: %v", ep.URL, err)
+	}
+
+	scheme := strings.TrimPrefix(u.Scheme, srvSchemePrefix)
+	switch scheme {
+	case "http", "https":
+	default:
+		return nil, nil, fmt.Errorf("unsupport scheme [%s]: %q", ep.URL, u.Scheme)
+	}
+
+	lookup := i.LookupSRVF
+	if lookup == nil {
+		lookup = lookupSRV
+	}
+	records, err := lookup(ctx, u.Hostname())
+	if err != nil {
+		return nil, nil, fmt.Errorf("error resolving [%s]: %v", ep.URL, err)
+	}
+
+	sort.SliceStable(records, func(a, b int) bool {
+		if records[a].Priority != records[b].Priority {
+			return records[a].Priority < records[b].Priority
+		}
+		return records[a].Weight > records[b].Weight
+	})
+
+	endpoints := make([]*Endpoint, 0, len(records))
+	for _, r := range records {
+		resolved := *u
+		resolved.Scheme = scheme
+		resolved.Host = net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+
+		e := *ep
+		e.URL = resolved.String()
+		if e.Weight == 0 {
+			e.Weight = srvWeight(r)
+		}
+		endpoints = append(endpoints, &e)
+	}
+	return endpoints, records, nil
+}
+
+// srvWeight returns the weight of the record.  Records with weight 0 are
+// only rarely selected.
+func srvWeight(r *net.SRV) float64 {
+	if r.Weight == 0 {
+		return 0.1
+	}
+	return float64(r.Weight)
+}
+
+// connectEndpoints returns a member for each endpoint, resolving the SRV
+// URLs.  Members of a previous call are kept for endpoints that did not
+// change, and for SRV URLs that could not be resolved.
+func (i *Orangesys) connectEndpoints(ctx context.Context, previous []*member) ([]*member, error) {
+	known := make(map[string]*member, len(previous))
+	for _, m := range previous {
+		known[m.key] = m
+	}
+
+	var members []*member
+	seen := make(map[string]bool)
+	for n, ep := range i.endpoints() {
+		if !isSRVURL(ep.URL) {
+			key := "#" + strconv.Itoa(n)
+			if m, ok := known[key]; ok {
+				members = append(members, m)
+				continue
+			}
+			m, err := i.newMember(ctx, key, ep, 0)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, m)
+			continue
+		}
+
+		endpoints, records, err := i.resolveSRV(ctx, ep)
+		if err != nil {
+			log.Printf("E! [outputs.orangesys] %v", err)
+			for _, m := range previous {
+				if strings.HasPrefix(m.key, ep.URL+"|") {
+					members = append(members, m)
+				}
+			}
+			continue
+		}
+
+		for k, resolved := range endpoints {
+			key := ep.URL + "|" + resolved.URL
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if m, ok := known[key]; ok {
+				m.weight = resolved.Weight
+				m.priority = int(records[k].Priority)
+				m.srvWeight = srvWeight(records[k])
+				members = append(members, m)
+				continue
+			}
+			m, err := i.newMember(ctx, key, resolved, int(records[k].Priority))
+			if err != nil {
+				log.Printf("E! [outputs.orangesys] %v", err)
+				continue
+			}
+			m.srvWeight = srvWeight(records[k])
+			members = append(members, m)
+		}
+	}
+	return members, nil
+}
+
+// newMember creates the client for the endpoint.
+func (i *Orangesys) newMember(ctx context.Context, key string, ep *Endpoint, priority int) (*member, error) {
+	config, err := i.endpointConfig(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	weight, err := i.endpointWeight(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := i.httpClient(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if i.CircuitBreakerFailureThreshold > 0 {
+		c = &breakerClient{
+			Client: c,
+			breaker: newCircuitBreaker(
+				i.CircuitBreakerFailureThreshold,
+				i.CircuitBreakerSuccessThreshold,
+				i.CircuitBreakerCooldown.Duration),
+		}
+	}
+
+	return &member{
+		key:       key,
+		client:    c,
+		weight:    weight,
+		priority:  priority,
+		stats:     &endpointStats{},
+		srvWeight: 1,
+	}, nil
+}
+
+// setMembers replaces the clients written to.  It waits for writes in
+// progress, then closes the connections of the clients that were removed.
+func (i *Orangesys) setMembers(members []*member) {
+	i.mu.Lock()
+
+	current := make(map[*member]bool, len(members))
+	for _, m := range members {
+		current[m] = true
+	}
+	var removed []*member
+	for _, m := range i.members {
+		if !current[m] {
+			removed = append(removed, m)
+		}
+	}
+	previous := make(map[*member]bool, len(i.members))
+	for _, m := range i.members {
+		previous[m] = true
+	}
+
+	i.members = members
+	i.clients = make([]Client, 0, len(members))
+	i.weights = make([]float64, 0, len(members))
+	i.priorities = make([]int, 0, len(members))
+	i.srvWeights = make([]float64, 0, len(members))
+	i.stats = make([]*endpointStats, 0, len(members))
+	for _, m := range members {
+		i.clients = append(i.clients, m.client)
+		i.weights = append(i.weights, m.weight)
+		i.priorities = append(i.priorities, m.priority)
+		i.srvWeights = append(i.srvWeights, m.srvWeight)
+		i.stats = append(i.stats, m.stats)
+	}
+
+	if i.WriteStrategy == writeStrategyShard {
+		urls := make([]string, 0, len(i.clients))
+		for _, c := range i.clients {
+			urls = append(urls, c.URL())
+		}
+		i.ring = newHashRing(urls, i.ShardVirtualNodes)
+	}
+	if i.health != nil {
+		i.health.SetClients(i.clients)
+	}
+
+	i.mu.Unlock()
+
+	if !i.discovery {
+		return
+	}
+	for _, m := range members {
+		if !previous[m] {
+			log.Printf("I! [outputs.orangesys] added [%s]", m.client.URL())
+		}
+	}
+	for _, m := range removed {
+		log.Printf("I! [outputs.orangesys] removed [%s]", m.client.URL())
+		m.client.CloseIdleConnections()
+	}
+}
+
+// startDiscovery resolves the SRV URLs again at every interval until
+// stopDiscovery is called.
+func (i *Orangesys) startDiscovery() {
+	ctx, cancel := context.WithCancel(context.Background())
+	i.discoveryCancel = cancel
+
+	i.discoveryWG.Add(1)
+	go func() {
+		defer i.discoveryWG.Done()
+
+		ticker := time.NewTicker(i.SRVRefreshInterval.Duration)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				i.refreshEndpoints(ctx)
+			}
+		}
+	}()
+}
+
+func (i *Orangesys) stopDiscovery() {
+	if i.discoveryCancel != nil {
+		i.discoveryCancel()
+	}
+	i.discoveryWG.Wait()
+}
+
+func (i *Orangesys) refreshEndpoints(ctx context.Context) {
+	i.mu.RLock()
+	previous := i.members
+	i.mu.RUnlock()
+
+	members, err := i.connectEndpoints(ctx, previous)
+	if err != nil {
+		log.Printf("E! [outputs.orangesys] refreshing endpoints: %v", err)
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	i.setMembers(members)
+}
@@ -0,0 +1,165 @@
+package orangesys
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Endpoint configures a server with its own credentials, database and TLS
+// settings.  Options that are not set fall back to the plugin options.
+type Endpoint struct {
+	URL             string            `toml:"url"`
+	JwtToken        string            `toml:"jwt_token"`
+	Database        string            `toml:"database"`
+	RetentionPolicy string            `toml:"retention_policy"`
+	HTTPHeaders     map[string]string `toml:"http_headers"`
+	HTTPProxy       string            `toml:"http_proxy"`
+	TLSServerName   string            `toml:"tls_server_name"`
+	TLSCA           string            `toml:"tls_ca"`
+	Weight          float64           `toml:"weight"`
+}
+
+// endpoints returns an endpoint using the plugin options for each of the
+// urls, followed by the endpoint tables.  The default URL is used when
+// neither is configured.
+func (i *Orangesys) endpoints() []*Endpoint {
+	urls := make([]string, 0, len(i.URLs))
+	urls = append(urls, i.URLs...)
+
+	if i.URL != "" {
+		urls = append(urls, i.URL)
+	}
+
+	if len(urls) == 0 && len(i.Endpoints) == 0 {
+		urls = append(urls, defaultURL)
+	}
+
+	endpoints := make([]*Endpoint, 0, len(urls)+len(i.Endpoints))
+	for _, u := range urls {
+		endpoints = append(endpoints, &Endpoint{URL: u})
+	}
+	return append(endpoints, i.Endpoints...)
+}
+
+// endpointConfig returns the client configuration for the endpoint.
+func (i *Orangesys) endpointConfig(ep *Endpoint) (*HTTPConfig, error) {
+	u, err := url.Parse(ep.URL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing url [%s]: %v", ep.URL, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "unix":
+	default:
+		return nil, fmt.Errorf("unsupport scheme [%s]: %q", u, u.Scheme)
+	}
+
+	httpProxy := i.HTTPProxy
+	if ep.HTTPProxy != "" {
+		httpProxy = ep.HTTPProxy
+	}
+
+	var proxy *url.URL
+	if len(httpProxy) > 0 {
+		proxy, err = url.Parse(httpProxy)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing proxy_url [%s]: %v", httpProxy, err)
+		}
+	}
+
+	tlsConfig, err := i.tlsConfig(ep)
+	if err != nil {
+		return nil, err
+	}
+
+	database := i.Database
+	if ep.Database != "" {
+		database = ep.Database
+	}
+
+	// Minted tokens carry the database in a claim, so endpoints writing
+	// to another database need tokens of their own.
+	jwtToken := i.JwtToken
+	tokenSource := i.tokenSource
+	switch {
+	case ep.JwtToken != "":
+		jwtToken = ep.JwtToken
+		tokenSource, err = i.userToken("jwt_token", ep.JwtToken)
+	case i.mintConfig != nil && ep.Database != "":
+		tokenSource, err = i.mintedToken(ep.Database)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("endpoint [%s]: %v", ep.URL, err)
+	}
+
+	httpHeaders := i.HTTPHeaders
+	if len(ep.HTTPHeaders) > 0 {
+		httpHeaders = make(map[string]string, len(i.HTTPHeaders)+len(ep.HTTPHeaders))
+		for k, v := range i.HTTPHeaders {
+			httpHeaders[k] = v
+		}
+		for k, v := range ep.HTTPHeaders {
+			httpHeaders[k] = v
+		}
+	}
+
+	authenticator := i.authenticator
+	headers := i.headers
+	if tokenSource != i.tokenSource || len(ep.HTTPHeaders) > 0 {
+		authenticator, headers, err = i.makeAuthenticator(tokenSource, httpHeaders)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint [%s]: %v", ep.URL, err)
+		}
+	}
+
+	// Metrics routed to other databases are sent with tokens minted for
+	// those databases.
+	var databaseAuthenticator func(string) (Authenticator, error)
+	if i.mintConfig != nil && ep.JwtToken == "" {
+		databaseAuthenticator = func(database string) (Authenticator, error) {
+			t, err := i.mintedToken(database)
+			if err != nil {
+				return nil, err
+			}
+			authenticator, _, err := i.makeAuthenticator(t, httpHeaders)
+			return authenticator, err
+		}
+	}
+
+	retentionPolicy := i.RetentionPolicy
+	if ep.RetentionPolicy != "" {
+		retentionPolicy = ep.RetentionPolicy
+	}
+
+	return &HTTPConfig{
+		URL:             u,
+		Timeout:         i.Timeout.Duration,
+		TLSConfig:       tlsConfig,
+		UserAgent:       i.UserAgent,
+		Username:        i.Username,
+		Password:        i.Password,
+		Proxy:           proxy,
+		ContentEncoding: i.ContentEncoding,
+		Headers:         headers,
+		Database:        database,
+		JwtToken:        jwtToken,
+		TokenSource:     tokenSource,
+		Authenticator:   authenticator,
+		Signer:          i.signer,
+		BatchIDHeader:   i.BatchIDHeader,
+		RetentionPolicy: retentionPolicy,
+		Consistency:     i.WriteConsistency,
+		Serializer:      i.newSerializer(),
+
+		DatabaseTag:          i.DatabaseTag,
+		ExcludeDatabaseTag:   i.ExcludeDatabaseTag,
+		DatabaseRules:        i.DatabaseRules,
+		SkipDatabaseCreation: i.SkipDatabaseCreation,
+
+		DatabaseAuthenticator: databaseAuthenticator,
+
+		RetentionPolicyTag:        i.RetentionPolicyTag,
+		ExcludeRetentionPolicyTag: i.ExcludeRetentionPolicyTag,
+		RetentionPolicyRules:      i.RetentionPolicyRules,
+	}, nil
+}
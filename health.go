@@ -0,0 +1,147 @@
+package orangesys
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+)
+
+// healthChecker pings every client in the background and tracks which
+// ones are unhealthy, so writes can go to healthy endpoints first.
+type healthChecker struct {
+	clients  []Client
+	interval time.Duration
+	timeout  time.Duration
+
+	mu        sync.RWMutex
+	unhealthy map[Client]bool
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newHealthChecker(clients []Client, interval, timeout time.Duration) *healthChecker {
+	if timeout <= 0 || timeout > interval {
+		timeout = interval
+	}
+	return &healthChecker{
+		clients:   clients,
+		interval:  interval,
+		timeout:   timeout,
+		unhealthy: make(map[Client]bool),
+	}
+}
+
+// Start runs the checks in the background until Stop is called.
+func (h *healthChecker) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.checkAll(ctx)
+			}
+		}
+	}()
+}
+
+// Stop ends the background checks and waits for them to return.
+func (h *healthChecker) Stop() {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	h.wg.Wait()
+}
+
+// Healthy reports if the last check of the client succeeded.  Clients are
+// healthy until a check fails.
+func (h *healthChecker) Healthy(c Client) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return !h.unhealthy[c]
+}
+
+// SetClients replaces the clients that are checked.
+func (h *healthChecker) SetClients(clients []Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.clients = clients
+	for c := range h.unhealthy {
+		if !h.checked(c) {
+			delete(h.unhealthy, c)
+		}
+	}
+}
+
+// checked reports if the client is still checked, h.mu must be held.
+func (h *healthChecker) checked(c Client) bool {
+	for _, client := range h.clients {
+		if client == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *healthChecker) checkAll(ctx context.Context) {
+	h.mu.RLock()
+	clients := h.clients
+	h.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c Client) {
+			defer wg.Done()
+			h.check(ctx, c)
+		}(c)
+	}
+	wg.Wait()
+}
+
+func (h *healthChecker) check(ctx context.Context, c Client) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	err := c.Ping(ctx)
+	if ctx.Err() == context.Canceled {
+		return
+	}
+
+	h.mu.Lock()
+	if !h.checked(c) {
+		h.mu.Unlock()
+		return
+	}
+	wasUnhealthy := h.unhealthy[c]
+	if err != nil {
+		h.unhealthy[c] = true
+	} else {
+		delete(h.unhealthy, c)
+	}
+	h.mu.Unlock()
+
+	switch {
+	case err != nil && !wasUnhealthy:
+		log.Printf("W! [outputs.orangesys] [%s] is unhealthy: %v", c.URL(), err)
+	case err == nil && wasUnhealthy:
+		log.Printf("I! [outputs.orangesys] [%s] is healthy again", c.URL())
+	}
+}
@@ -1,18 +1,23 @@
 package orangesys
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/influxdata/telegraf"
@@ -54,6 +59,12 @@ type APIError struct {
 	Title       string
 	Description string
 	Type        APIErrorType
+
+	// RetryAfter is the delay requested by the server with Retry-After.
+	RetryAfter time.Duration
+
+	// Database is the database that was written to.
+	Database string
 }
 
 func (e APIError) Error() string {
@@ -63,6 +74,28 @@ func (e APIError) Error() string {
 	return e.Title
 }
 
+// AuthError is returned when the server rejected the credentials with 401
+// or denied access to the database with 403.
+type AuthError struct {
+	StatusCode  int
+	Title       string
+	Description string
+	URL         string
+	Database    string
+}
+
+func (e *AuthError) Error() string {
+	reason := e.Title
+	if e.Description != "" {
+		reason = fmt.Sprintf("%s: %s", e.Title, e.Description)
+	}
+
+	if e.StatusCode == http.StatusForbidden {
+		return fmt.Sprintf("access to database %q denied: %s", e.Database, reason)
+	}
+	return fmt.Sprintf("authentication failed: %s", reason)
+}
+
 // QueryResponse is the response body from the /query endpoint
 type QueryResponse struct {
 	Results []QueryResult `json:"results"`
@@ -105,6 +138,45 @@ type HTTPConfig struct {
 	// JwtToken is jwt auth for the server with orangeysys
 	JwtToken string
 
+	// TokenSource supplies the bearer token for each request, it takes
+	// precedence over JwtToken when set.
+	TokenSource TokenSource
+
+	// Authenticator adds credentials to each request, it takes precedence
+	// over TokenSource and JwtToken when set.
+	Authenticator Authenticator
+
+	// Signer signs each request, requests are not signed when nil.
+	Signer *RequestSigner
+
+	// BatchIDHeader is the header carrying the batch ID of each write,
+	// derived from the content so it is the same on every retry.  No
+	// batch ID is sent when empty.
+	BatchIDHeader string
+
+	// DatabaseTag names the tag whose value is the database of a metric,
+	// the tag is removed before writing with ExcludeDatabaseTag.  Metrics
+	// without the tag are written to the database of the first of the
+	// DatabaseRules matching their measurement, or to Database.
+	DatabaseTag        string
+	ExcludeDatabaseTag bool
+	DatabaseRules      []*DatabaseRule
+
+	// RetentionPolicyTag and RetentionPolicyRules select the retention
+	// policy of a metric in the same way, falling back to RetentionPolicy.
+	RetentionPolicyTag        string
+	ExcludeRetentionPolicyTag bool
+	RetentionPolicyRules      []*RetentionPolicyRule
+
+	// SkipDatabaseCreation disables creating the databases selected by
+	// DatabaseTag and DatabaseRules before the first write.
+	SkipDatabaseCreation bool
+
+	// DatabaseAuthenticator returns the Authenticator for requests to a
+	// database other than Database, for credentials that are only valid
+	// for one database.  Authenticator is used for all databases when nil.
+	DatabaseAuthenticator func(database string) (Authenticator, error)
+
 	InfluxUintSupport bool `toml:"influx_uint_support"`
 	Serializer        *influx.Serializer
 }
@@ -112,16 +184,37 @@ type HTTPConfig struct {
 type httpClient struct {
 	WriteURL        string
 	QueryURL        string
+	PingURL         string
 	ContentEncoding string
 	Timeout         time.Duration
 	Username        string
 	Password        string
 	Headers         map[string]string
 
-	client     *http.Client
-	serializer *influx.Serializer
-	url        *url.URL
-	database   string
+	authenticator Authenticator
+	signer        *RequestSigner
+	batchIDHeader string
+	client        *http.Client
+	serializer    *influx.Serializer
+	url           *url.URL
+	database      string
+
+	retentionPolicy      string
+	consistency          string
+	databaseTag          string
+	excludeDatabaseTag   bool
+	databaseRules        []*DatabaseRule
+	skipDatabaseCreation bool
+
+	retentionPolicyTag        string
+	excludeRetentionPolicyTag bool
+	retentionPolicyRules      []*RetentionPolicyRule
+
+	databaseAuthenticator func(database string) (Authenticator, error)
+
+	mu               sync.Mutex
+	createdDatabases map[string]bool
+	authenticators   map[string]Authenticator
 }
 
 func NewHTTPClient(config *HTTPConfig) (*httpClient, error) {
@@ -144,14 +237,20 @@ func NewHTTPClient(config *HTTPConfig) (*httpClient, error) {
 		userAgent = defaultUserAgent
 	}
 
-	jwtToken := config.JwtToken
-	if jwtToken == "" {
-		return nil, fmt.Errorf("JwtToken don's empty")
+	authenticator := config.Authenticator
+	if authenticator == nil {
+		tokenSource := config.TokenSource
+		if tokenSource == nil {
+			if config.JwtToken == "" {
+				return nil, fmt.Errorf("JwtToken don's empty")
+			}
+			tokenSource = staticToken(config.JwtToken)
+		}
+		authenticator = NewBearerAuthenticator(tokenSource)
 	}
 
 	var headers = make(map[string]string, len(config.Headers)+1)
 	headers["User-Agent"] = userAgent
-	headers["Authorization"] = "Bearer " + jwtToken
 	for k, v := range config.Headers {
 		headers[k] = v
 	}
@@ -180,6 +279,10 @@ func NewHTTPClient(config *HTTPConfig) (*httpClient, error) {
 	if err != nil {
 		return nil, err
 	}
+	pingURL, err := makePingURL(config.URL)
+	if err != nil {
+		return nil, err
+	}
 
 	var transport *http.Transport
 	switch config.URL.Scheme {
@@ -212,11 +315,30 @@ func NewHTTPClient(config *HTTPConfig) (*httpClient, error) {
 		url:             config.URL,
 		WriteURL:        writeURL,
 		QueryURL:        queryURL,
+		PingURL:         pingURL,
 		ContentEncoding: config.ContentEncoding,
 		Timeout:         timeout,
 		Username:        config.Username,
 		Password:        config.Password,
 		Headers:         headers,
+		authenticator:   authenticator,
+		signer:          config.Signer,
+		batchIDHeader:   config.BatchIDHeader,
+
+		retentionPolicy:      config.RetentionPolicy,
+		consistency:          config.Consistency,
+		databaseTag:          config.DatabaseTag,
+		excludeDatabaseTag:   config.ExcludeDatabaseTag,
+		databaseRules:        config.DatabaseRules,
+		skipDatabaseCreation: config.SkipDatabaseCreation,
+		createdDatabases:     make(map[string]bool),
+
+		retentionPolicyTag:        config.RetentionPolicyTag,
+		excludeRetentionPolicyTag: config.ExcludeRetentionPolicyTag,
+		retentionPolicyRules:      config.RetentionPolicyRules,
+
+		databaseAuthenticator: config.DatabaseAuthenticator,
+		authenticators:        make(map[string]Authenticator),
 	}
 	return client, nil
 }
@@ -235,17 +357,32 @@ func (c *httpClient) Database() string {
 // Note that some names are not allowed by the server, notably those with
 // non-printable characters or slashes.
 func (c *httpClient) CreateDatabase(ctx context.Context) error {
+	return c.CreateDatabaseNamed(ctx, c.database)
+}
+
+// CreateDatabaseNamed creates a database other than the one of the client,
+// which metrics are routed to.
+func (c *httpClient) CreateDatabaseNamed(ctx context.Context, database string) error {
 	query := fmt.Sprintf(`CREATE DATABASE "%s"`,
-		escapeIdentifier.Replace(c.database))
+		escapeIdentifier.Replace(database))
 
-	req, err := c.makeQueryRequest(query)
+	auth, err := c.authenticatorFor(database)
+	if err != nil {
+		return err
+	}
 
-	resp, err := c.client.Do(req.WithContext(ctx))
+	req, resp, err := c.do(ctx, auth, func() (*http.Request, error) {
+		return c.makeQueryRequest(query, auth)
+	})
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	if err := c.authError(req, resp, database); err != nil {
+		return err
+	}
+
 	queryResp := &QueryResponse{}
 	dec := json.NewDecoder(resp.Body)
 	err = dec.Decode(queryResp)
@@ -273,17 +410,154 @@ func (c *httpClient) CreateDatabase(ctx context.Context) error {
 	}
 }
 
-// Write sends the metrics to InfluxDB
+// CloseIdleConnections closes the keep-alive connections to the server.
+func (c *httpClient) CloseIdleConnections() {
+	c.client.CloseIdleConnections()
+}
+
+// Ping checks that the server is up using the /ping endpoint.
+func (c *httpClient) Ping(ctx context.Context) error {
+	req, resp, err := c.do(ctx, c.authenticator, c.makePingRequest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	if err := c.authError(req, resp, c.database); err != nil {
+		return err
+	}
+
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Title:      resp.Status,
+		RetryAfter: parseRetryAfter(resp, time.Now()),
+	}
+}
+
+// Write sends the metrics to InfluxDB, with one request for each database
+// and retention policy the metrics are routed to.
 func (c *httpClient) Write(ctx context.Context, metrics []telegraf.Metric) error {
-	var err error
+	if !c.routed() {
+		return c.writeTo(ctx, c.defaultDestination(), metrics)
+	}
+
+	destinations, batches := c.groupByDestination(metrics)
+	return c.writeEach(len(destinations), func(n int) ([]telegraf.Metric, error) {
+		dest := destinations[n]
+		if dest.database != c.database {
+			c.ensureDatabase(ctx, dest.database)
+		}
+		return batches[dest], c.writeTo(ctx, dest, batches[dest])
+	})
+}
+
+// writeTo writes the metrics to the database and retention policy.  If the
+// server rejects the request as too large, the metrics are split in halves
+// that are sent separately.
+func (c *httpClient) writeTo(ctx context.Context, dest destination, metrics []telegraf.Metric) error {
+	err := c.write(ctx, dest, metrics)
+	if apiErr, ok := err.(*APIError); ok && apiErr.StatusCode == http.StatusRequestEntityTooLarge {
+		return c.writeSplit(ctx, dest, metrics)
+	}
+	return err
+}
+
+// writeEach calls write for each of the parts of a batch.  The metrics
+// rejected in any part are reported together, other errors stop the write.
+func (c *httpClient) writeEach(parts int, write func(n int) ([]telegraf.Metric, error)) error {
+	accepted := 0
+	var partial *PartialWriteError
+	for n := 0; n < parts; n++ {
+		metrics, err := write(n)
+		switch err := err.(type) {
+		case nil:
+			accepted += len(metrics)
+		case *PartialWriteError:
+			if partial == nil {
+				partial = &PartialWriteError{URL: c.URL()}
+			}
+			partial.merge(err)
+		default:
+			return err
+		}
+	}
+
+	if partial != nil {
+		partial.Accepted += accepted
+		return partial
+	}
+	return nil
+}
+
+// writeSplit bisects the metrics and writes each half, splitting further
+// while the server answers 413.  A single metric that is still too large is
+// rejected, as retrying it can never succeed.
+func (c *httpClient) writeSplit(ctx context.Context, dest destination, metrics []telegraf.Metric) error {
+	if len(metrics) == 1 {
+		return &PartialWriteError{
+			URL:        c.URL(),
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Rejected: []RejectedMetric{
+				{
+					Metric:          metrics[0],
+					Reason:          "request entity too large",
+					Database:        dest.database,
+					RetentionPolicy: dest.retentionPolicy,
+				},
+			},
+		}
+	}
 
-	reader := influx.NewReader(metrics, c.serializer)
-	req, err := c.makeWriteRequest(reader)
+	half := len(metrics) / 2
+	log.Printf("D! [outputs.orangesys]: when writing to [%s]: request too large, splitting batch of %d metrics",
+		c.URL(), len(metrics))
+
+	parts := [][]telegraf.Metric{metrics[:half], metrics[half:]}
+	return c.writeEach(len(parts), func(n int) ([]telegraf.Metric, error) {
+		return parts[n], c.writeTo(ctx, dest, parts[n])
+	})
+}
+
+func (c *httpClient) write(ctx context.Context, dest destination, metrics []telegraf.Metric) error {
+	writeURL := c.WriteURL
+	if dest != c.defaultDestination() {
+		var err error
+		writeURL, err = makeWriteURL(c.url, dest.database, dest.retentionPolicy, c.consistency)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The batch ID is a hash of the line protocol, so it is the same for
+	// every retry, on every server and after replay from the disk queue.
+	var body []byte
+	var batchID string
+	if c.batchIDHeader != "" {
+		var err error
+		body, err = ioutil.ReadAll(influx.NewReader(metrics, c.serializer))
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(body)
+		batchID = hex.EncodeToString(sum[:16])
+	}
+
+	auth, err := c.authenticatorFor(dest.database)
 	if err != nil {
 		return err
 	}
 
-	resp, err := c.client.Do(req.WithContext(ctx))
+	req, resp, err := c.do(ctx, auth, func() (*http.Request, error) {
+		if body != nil {
+			return c.makeWriteRequest(writeURL, bytes.NewReader(body), batchID, auth)
+		}
+		reader := influx.NewReader(metrics, c.serializer)
+		return c.makeWriteRequest(writeURL, reader, batchID, auth)
+	})
 	if err != nil {
 		return err
 	}
@@ -293,6 +567,10 @@ func (c *httpClient) Write(ctx context.Context, metrics []telegraf.Metric) error
 		return nil
 	}
 
+	if err := c.authError(req, resp, dest.database); err != nil {
+		return err
+	}
+
 	writeResp := &WriteResponse{}
 	dec := json.NewDecoder(resp.Body)
 
@@ -308,6 +586,7 @@ func (c *httpClient) Write(ctx context.Context, metrics []telegraf.Metric) error
 			Title:       resp.Status,
 			Description: desc,
 			Type:        DatabaseNotFound,
+			Database:    dest.database,
 		}
 	}
 
@@ -317,40 +596,31 @@ func (c *httpClient) Write(ctx context.Context, metrics []telegraf.Metric) error
 		return nil
 	}
 
-	// Points beyond retention policy is returned when points are immediately
-	// discarded for being older than the retention policy.  Usually this not
-	// a cause for concern and we don't want to retry.
-	if strings.Contains(desc, errStringPointsBeyondRP) {
-		log.Printf("W! [outputs.influxdb]: when writing to [%s]: received error %v",
-			c.URL(), desc)
-		return nil
-	}
-
-	// Other partial write errors, such as "field type conflict", are not
-	// correctable at this point and so the point is dropped instead of
-	// retrying.
-	if strings.Contains(desc, errStringPartialWrite) {
-		log.Printf("E! [outputs.influxdb]: when writing to [%s]: received error %v; discarding points",
-			c.URL(), desc)
-		return nil
-	}
-
-	// This error indicates a bug in either Telegraf line protocol
-	// serialization, retries would not be successful.
-	if strings.Contains(desc, errStringUnableToParse) {
-		log.Printf("E! [outputs.influxdb]: when writing to [%s]: received error %v; discarding points",
-			c.URL(), desc)
-		return nil
+	// Points beyond retention policy, other partial write errors such as
+	// "field type conflict", and lines the server was unable to parse are
+	// not correctable at this point.  The rest of the batch was written, so
+	// the rejected points are reported instead of retrying.
+	if strings.Contains(desc, errStringPointsBeyondRP) ||
+		strings.Contains(desc, errStringPartialWrite) ||
+		strings.Contains(desc, errStringUnableToParse) {
+		partial := c.partialWriteError(metrics, resp.StatusCode, desc)
+		for n := range partial.Rejected {
+			partial.Rejected[n].Database = dest.database
+			partial.Rejected[n].RetentionPolicy = dest.retentionPolicy
+		}
+		return partial
 	}
 
 	return &APIError{
 		StatusCode:  resp.StatusCode,
 		Title:       resp.Status,
 		Description: desc,
+		RetryAfter:  parseRetryAfter(resp, time.Now()),
+		Database:    dest.database,
 	}
 }
 
-func (c *httpClient) makeQueryRequest(query string) (*http.Request, error) {
+func (c *httpClient) makeQueryRequest(query string, auth Authenticator) (*http.Request, error) {
 	params := url.Values{}
 	params.Set("q", query)
 	form := strings.NewReader(params.Encode())
@@ -361,12 +631,39 @@ func (c *httpClient) makeQueryRequest(query string) (*http.Request, error) {
 	}
 
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	c.addHeaders(req)
+	if err := c.addHeaders(req, auth); err != nil {
+		return nil, err
+	}
+
+	if c.signer != nil {
+		if err := c.signer.Sign(req); err != nil {
+			return nil, err
+		}
+	}
 
 	return req, nil
 }
 
-func (c *httpClient) makeWriteRequest(body io.Reader) (*http.Request, error) {
+func (c *httpClient) makePingRequest() (*http.Request, error) {
+	req, err := http.NewRequest("GET", c.PingURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.addHeaders(req, c.authenticator); err != nil {
+		return nil, err
+	}
+
+	if c.signer != nil {
+		if err := c.signer.Sign(req); err != nil {
+			return nil, err
+		}
+	}
+
+	return req, nil
+}
+
+func (c *httpClient) makeWriteRequest(writeURL string, body io.Reader, batchID string, auth Authenticator) (*http.Request, error) {
 	var err error
 	if c.ContentEncoding == "gzip" {
 		body, err = compressWithGzip(body)
@@ -375,18 +672,30 @@ func (c *httpClient) makeWriteRequest(body io.Reader) (*http.Request, error) {
 		}
 	}
 
-	req, err := http.NewRequest("POST", c.WriteURL, body)
+	req, err := http.NewRequest("POST", writeURL, body)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
-	c.addHeaders(req)
+	if err := c.addHeaders(req, auth); err != nil {
+		return nil, err
+	}
 
 	if c.ContentEncoding == "gzip" {
 		req.Header.Set("Content-Encoding", "gzip")
 	}
 
+	if batchID != "" {
+		req.Header.Set(c.batchIDHeader, batchID)
+	}
+
+	if c.signer != nil {
+		if err := c.signer.Sign(req); err != nil {
+			return nil, err
+		}
+	}
+
 	return req, nil
 }
 
@@ -404,14 +713,95 @@ func compressWithGzip(data io.Reader) (io.Reader, error) {
 	return pr, err
 }
 
-func (c *httpClient) addHeaders(req *http.Request) {
-	if c.Username != "" || c.Password != "" {
-		req.SetBasicAuth(c.Username, c.Password)
-	}
-
+func (c *httpClient) addHeaders(req *http.Request, auth Authenticator) error {
 	for header, value := range c.Headers {
 		req.Header.Set(header, value)
 	}
+
+	return auth.Authenticate(req)
+}
+
+// authenticatorFor returns the Authenticator for requests to the database.
+func (c *httpClient) authenticatorFor(database string) (Authenticator, error) {
+	if c.databaseAuthenticator == nil || database == c.database {
+		return c.authenticator, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if auth, ok := c.authenticators[database]; ok {
+		return auth, nil
+	}
+	auth, err := c.databaseAuthenticator(database)
+	if err != nil {
+		return nil, err
+	}
+	c.authenticators[database] = auth
+	return auth, nil
+}
+
+// do sends the request built by makeRequest with the credentials of auth.
+// When the server answers 401 and the authenticator was able to refresh
+// the credentials, the request is built again and retried once on the same
+// endpoint.
+func (c *httpClient) do(ctx context.Context, auth Authenticator, makeRequest func() (*http.Request, error)) (*http.Request, *http.Response, error) {
+	req, err := makeRequest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized || !auth.Unauthorized(resp) {
+		return req, resp, nil
+	}
+	resp.Body.Close()
+
+	log.Printf("D! [outputs.orangesys] when writing to [%s]: credentials refreshed, retrying", c.URL())
+
+	req, err = makeRequest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err = c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	return req, resp, nil
+}
+
+// authError returns an AuthError when the server rejected the credentials
+// or denied access to the database the request was for, or a
+// TokenExpiredError when the request was rejected because the token that
+// was sent has expired.
+func (c *httpClient) authError(req *http.Request, resp *http.Response, database string) error {
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		return nil
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if expired := tokenExpired(token, time.Now()); expired != nil {
+			expired.URL = c.URL()
+			return expired
+		}
+	}
+
+	writeResp := &WriteResponse{}
+	json.NewDecoder(resp.Body).Decode(writeResp)
+
+	return &AuthError{
+		StatusCode:  resp.StatusCode,
+		Title:       resp.Status,
+		Description: writeResp.Err,
+		URL:         c.URL(),
+		Database:    database,
+	}
 }
 
 func makeWriteURL(loc *url.URL, db, rp, consistency string) (string, error) {
@@ -455,3 +845,18 @@ func makeQueryURL(loc *url.URL) (string, error) {
 	}
 	return u.String(), nil
 }
+
+func makePingURL(loc *url.URL) (string, error) {
+	u := *loc
+	switch u.Scheme {
+	case "unix":
+		u.Scheme = "http"
+		u.Host = "127.0.0.1"
+		u.Path = "/ping"
+	case "http", "https":
+		u.Path = path.Join(u.Path, "ping")
+	default:
+		return "", fmt.Errorf("unsupported scheme: %q", loc.Scheme)
+	}
+	return u.String(), nil
+}
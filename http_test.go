@@ -0,0 +1,342 @@
+package orangesys_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/plugins/outputs/orangesys"
+	"github.com/stretchr/testify/require"
+)
+
+type MockAuthenticator struct {
+	AuthenticateF func(req *http.Request) error
+	UnauthorizedF func(resp *http.Response) bool
+}
+
+func (a *MockAuthenticator) Authenticate(req *http.Request) error {
+	return a.AuthenticateF(req)
+}
+
+func (a *MockAuthenticator) Unauthorized(resp *http.Response) bool {
+	return a.UnauthorizedF(resp)
+}
+
+func testMetrics(t *testing.T) []telegraf.Metric {
+	m, err := metric.New(
+		"cpu",
+		map[string]string{},
+		map[string]interface{}{
+			"value": 42.0,
+		},
+		time.Unix(0, 0),
+	)
+	require.NoError(t, err)
+	return []telegraf.Metric{m}
+}
+
+func TestHTTPClientAuthenticator(t *testing.T) {
+	tests := []struct {
+		name          string
+		authenticator orangesys.Authenticator
+		expected      string
+	}{
+		{
+			name:          "bearer",
+			authenticator: orangesys.NewBearerAuthenticator(staticTokenSource("abc")),
+			expected:      "Bearer abc",
+		},
+		{
+			name:          "basic",
+			authenticator: orangesys.NewBasicAuthenticator("guy", "smiley"),
+			expected:      "Basic Z3V5OnNtaWxleQ==",
+		},
+		{
+			name:          "none",
+			authenticator: orangesys.NoAuthenticator{},
+			expected:      "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var authorization string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authorization = r.Header.Get("Authorization")
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer ts.Close()
+
+			client, err := orangesys.NewHTTPClient(&orangesys.HTTPConfig{
+				URL:           mustParseURL(t, ts.URL),
+				Authenticator: tt.authenticator,
+			})
+			require.NoError(t, err)
+
+			err = client.Write(context.Background(), testMetrics(t))
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, authorization)
+		})
+	}
+}
+
+func TestHTTPClientNotifiesAuthenticatorOnUnauthorized(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	var unauthorized int
+	client, err := orangesys.NewHTTPClient(&orangesys.HTTPConfig{
+		URL: mustParseURL(t, ts.URL),
+		Authenticator: &MockAuthenticator{
+			AuthenticateF: func(req *http.Request) error {
+				req.Header.Set("X-Api-Key", "key")
+				return nil
+			},
+			UnauthorizedF: func(resp *http.Response) bool {
+				unauthorized++
+				return false
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	err = client.Write(context.Background(), testMetrics(t))
+	require.Error(t, err)
+	require.IsType(t, &orangesys.AuthError{}, err)
+	require.Equal(t, 1, unauthorized)
+}
+
+type staticTokenSource string
+
+func (s staticTokenSource) Token() (string, error) {
+	return string(s), nil
+}
+
+func TestHTTPClientSignsRequests(t *testing.T) {
+	key := []byte("signing-key")
+	var verified bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		timestamp := r.Header.Get("X-Timestamp")
+		bodyHash := sha256.Sum256(body)
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(r.Method + "\n" + r.URL.RequestURI() + "\n" + timestamp + "\n" + hex.EncodeToString(bodyHash[:])))
+
+		require.Equal(t, "/write?db=telegraf", r.URL.RequestURI())
+		require.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get("X-Signature"))
+		verified = true
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	client, err := orangesys.NewHTTPClient(&orangesys.HTTPConfig{
+		URL:             mustParseURL(t, ts.URL),
+		JwtToken:        "jwt_token",
+		ContentEncoding: "gzip",
+		Signer: &orangesys.RequestSigner{
+			Key:             key,
+			SignatureHeader: "X-Signature",
+			TimestampHeader: "X-Timestamp",
+		},
+	})
+	require.NoError(t, err)
+
+	err = client.Write(context.Background(), testMetrics(t))
+	require.NoError(t, err)
+	require.True(t, verified)
+}
+
+func TestHTTPClientPing(t *testing.T) {
+	var path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	client, err := orangesys.NewHTTPClient(&orangesys.HTTPConfig{
+		URL:      mustParseURL(t, ts.URL+"/orangesys"),
+		JwtToken: "jwt_token",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, client.Ping(context.Background()))
+	require.Equal(t, "/orangesys/ping", path)
+
+	ts.Close()
+	require.Error(t, client.Ping(context.Background()))
+}
+
+func TestHTTPClientSplitsBatchOnRequestEntityTooLarge(t *testing.T) {
+	var received []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		if len(body) > 30 {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		received = append(received, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	client, err := orangesys.NewHTTPClient(&orangesys.HTTPConfig{
+		URL:      mustParseURL(t, ts.URL),
+		JwtToken: "jwt_token",
+	})
+	require.NoError(t, err)
+
+	var metrics []telegraf.Metric
+	for _, name := range []string{"a", "b", "c", "d", "oversized_measurement_name"} {
+		m, err := metric.New(
+			name,
+			map[string]string{},
+			map[string]interface{}{
+				"value": 42.0,
+			},
+			time.Unix(0, 0),
+		)
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+
+	err = client.Write(context.Background(), metrics)
+	require.Equal(t, []string{
+		"a value=42 0\nb value=42 0\n",
+		"c value=42 0\n",
+		"d value=42 0\n",
+	}, received)
+
+	partial, ok := err.(*orangesys.PartialWriteError)
+	require.True(t, ok, "expected *PartialWriteError, got %v", err)
+	require.Equal(t, 4, partial.Accepted)
+	require.Len(t, partial.Rejected, 1)
+	require.Equal(t, "oversized_measurement_name", partial.Rejected[0].Metric.Name())
+}
+
+func TestHTTPClientPartialWrite(t *testing.T) {
+	newMetric := func(name string, fields map[string]interface{}, sec int64) telegraf.Metric {
+		m, err := metric.New(name, map[string]string{}, fields, time.Unix(sec, 0))
+		require.NoError(t, err)
+		return m
+	}
+
+	metrics := []telegraf.Metric{
+		newMetric("cpu", map[string]interface{}{"value": 42.0}, 3),
+		newMetric("cpu", map[string]interface{}{"value": int64(42)}, 2),
+		newMetric("mem", map[string]interface{}{"value": 42.0}, 1),
+		newMetric("disk", map[string]interface{}{"value": 42.0}, 4),
+	}
+
+	tests := []struct {
+		name         string
+		body         string
+		accepted     int
+		rejected     []string
+		unidentified int
+	}{
+		{
+			name:     "field type conflict",
+			body:     `{"error":"partial write: field type conflict: input field \"value\" on measurement \"cpu\" is type integer, already exists as type float dropped=1"}`,
+			accepted: 3,
+			rejected: []string{"cpu"},
+		},
+		{
+			name:     "beyond retention policy",
+			body:     `{"error":"partial write: points beyond retention policy dropped=2"}`,
+			accepted: 2,
+			rejected: []string{"cpu", "mem"},
+		},
+		{
+			name:         "beyond retention policy more than sent",
+			body:         `{"error":"partial write: points beyond retention policy dropped=9"}`,
+			accepted:     0,
+			rejected:     []string{"cpu", "cpu", "mem", "disk"},
+			unidentified: 5,
+		},
+		{
+			name:     "unable to parse",
+			body:     `{"error":"unable to parse 'disk value=42 4000000000': invalid field format"}`,
+			accepted: 3,
+			rejected: []string{"disk"},
+		},
+		{
+			name:         "unable to parse without line",
+			body:         `{"error":"partial write: unable to parse ': bad"}`,
+			accepted:     0,
+			unidentified: 4,
+		},
+		{
+			name:         "unknown reason",
+			body:         `{"error":"partial write: something else dropped=2"}`,
+			accepted:     2,
+			unidentified: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(tt.body))
+			}))
+			defer ts.Close()
+
+			client, err := orangesys.NewHTTPClient(&orangesys.HTTPConfig{
+				URL:      mustParseURL(t, ts.URL),
+				JwtToken: "jwt_token",
+			})
+			require.NoError(t, err)
+
+			err = client.Write(context.Background(), metrics)
+			partial, ok := err.(*orangesys.PartialWriteError)
+			require.True(t, ok, "expected *PartialWriteError, got %v", err)
+			require.Equal(t, tt.accepted, partial.Accepted)
+			require.Equal(t, tt.unidentified, partial.Unidentified)
+
+			var rejected []string
+			for _, r := range partial.Rejected {
+				rejected = append(rejected, r.Metric.Name())
+			}
+			require.Equal(t, tt.rejected, rejected)
+		})
+	}
+}
+
+func TestHTTPClientForbiddenNamesRoutedDatabase(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error":"user is not authorized to write to database"}`))
+	}))
+	defer ts.Close()
+
+	client, err := orangesys.NewHTTPClient(&orangesys.HTTPConfig{
+		URL:                  mustParseURL(t, ts.URL),
+		Database:             "telegraf",
+		JwtToken:             "jwt_token",
+		DatabaseTag:          "team",
+		SkipDatabaseCreation: true,
+	})
+	require.NoError(t, err)
+
+	m, err := metric.New("cpu", map[string]string{"team": "team_a"},
+		map[string]interface{}{"value": 42.0}, time.Unix(0, 0))
+	require.NoError(t, err)
+
+	err = client.Write(context.Background(), []telegraf.Metric{m})
+	authErr, ok := err.(*orangesys.AuthError)
+	require.True(t, ok, "expected *AuthError, got %v", err)
+	require.Equal(t, "team_a", authErr.Database)
+	require.Contains(t, err.Error(), `access to database "team_a" denied`)
+}
@@ -0,0 +1,373 @@
+package orangesys
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenExpiredError is returned when a jwt token has passed its exp claim,
+// either before connecting or when the server rejected a request with 401.
+type TokenExpiredError struct {
+	URL       string
+	ExpiredAt time.Time
+}
+
+func (e *TokenExpiredError) Error() string {
+	msg := fmt.Sprintf("jwt token expired at %s", e.ExpiredAt.Format(time.RFC3339))
+	if e.URL != "" {
+		msg = fmt.Sprintf("when writing to [%s]: %s", e.URL, msg)
+	}
+	return msg
+}
+
+// jwtClaims holds the registered time claims of a jwt token.  The signature
+// is not verified, the claims are only used to report on the token lifetime.
+type jwtClaims struct {
+	ExpiresAt float64 `json:"exp"`
+	NotBefore float64 `json:"nbf"`
+	IssuedAt  float64 `json:"iat"`
+}
+
+func parseJWTClaims(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a jwt")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding jwt payload: %v", err)
+	}
+
+	claims := &jwtClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("error decoding jwt claims: %v", err)
+	}
+	return claims, nil
+}
+
+func claimTime(v float64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	sec := int64(v)
+	return time.Unix(sec, int64((v-float64(sec))*1e9))
+}
+
+func (c *jwtClaims) expiresAt() time.Time { return claimTime(c.ExpiresAt) }
+func (c *jwtClaims) notBefore() time.Time { return claimTime(c.NotBefore) }
+func (c *jwtClaims) issuedAt() time.Time  { return claimTime(c.IssuedAt) }
+
+// tokenExpired returns a TokenExpiredError if the token has an exp claim that is
+// in the past.
+func tokenExpired(token string, now time.Time) *TokenExpiredError {
+	claims, err := parseJWTClaims(token)
+	if err != nil {
+		return nil
+	}
+
+	exp := claims.expiresAt()
+	if exp.IsZero() || now.Before(exp) {
+		return nil
+	}
+	return &TokenExpiredError{ExpiredAt: exp}
+}
+
+// expiryWarner logs a warning each time the remaining lifetime of the token
+// drops below one of the configured thresholds.
+type expiryWarner struct {
+	thresholds []time.Duration
+
+	mu     sync.Mutex
+	token  string
+	claims *jwtClaims
+	warned int
+}
+
+func newExpiryWarner(thresholds []time.Duration) *expiryWarner {
+	t := make([]time.Duration, len(thresholds))
+	copy(t, thresholds)
+	sort.Slice(t, func(i, j int) bool { return t[i] > t[j] })
+
+	return &expiryWarner{thresholds: t}
+}
+
+// Check inspects the claims of the token, logging a warning for every
+// threshold crossed since the last call.  It returns a TokenExpiredError if
+// the token has already expired.
+func (w *expiryWarner) Check(token string, now time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if token != w.token {
+		w.token = token
+		w.warned = 0
+		w.claims = nil
+
+		claims, err := parseJWTClaims(token)
+		if err != nil {
+			log.Printf("W! [outputs.orangesys] unable to check jwt token expiry: %v", err)
+			return nil
+		}
+		w.claims = claims
+
+		if nbf := claims.notBefore(); !nbf.IsZero() && now.Before(nbf) {
+			log.Printf("W! [outputs.orangesys] jwt token is not valid before %s",
+				nbf.Format(time.RFC3339))
+		}
+		if iat := claims.issuedAt(); !iat.IsZero() && now.Before(iat) {
+			log.Printf("W! [outputs.orangesys] jwt token issued in the future at %s, check the system clock",
+				iat.Format(time.RFC3339))
+		}
+	}
+
+	if w.claims == nil {
+		return nil
+	}
+
+	exp := w.claims.expiresAt()
+	if exp.IsZero() {
+		return nil
+	}
+
+	remaining := exp.Sub(now)
+	if remaining <= 0 {
+		return &TokenExpiredError{ExpiredAt: exp}
+	}
+
+	crossed := w.warned
+	for crossed < len(w.thresholds) && remaining <= w.thresholds[crossed] {
+		crossed++
+	}
+	if crossed > w.warned {
+		w.warned = crossed
+		log.Printf("W! [outputs.orangesys] jwt token expires in %s at %s",
+			remaining.Truncate(time.Second), exp.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// tokenCheck pairs a token source with the warner tracking its expiry.
+type tokenCheck struct {
+	source TokenSource
+	warner *expiryWarner
+}
+
+// Check warns about the current token if it is about to expire and returns
+// a TokenExpiredError if it already has.
+func (c *tokenCheck) Check() error {
+	token, err := c.source.Token()
+	if err != nil {
+		return err
+	}
+	return c.warner.Check(token, time.Now())
+}
+
+const (
+	defaultJWTTTL = 5 * time.Minute
+)
+
+// jwtMintConfig configures locally minted jwt tokens.
+type jwtMintConfig struct {
+	Method   string
+	KeyFile  string
+	Issuer   string
+	Subject  string
+	Audience string
+	Tenant   string
+	Database string
+	TTL      time.Duration
+}
+
+// mintedToken signs short-lived jwt tokens with a local key and mints a
+// new one before the current one expires.
+type mintedToken struct {
+	config *jwtMintConfig
+	sign   func(data []byte) ([]byte, error)
+
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+func newMintedToken(config *jwtMintConfig) (*mintedToken, error) {
+	key, err := ioutil.ReadFile(config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading jwt_signing_key_file: %v", err)
+	}
+
+	sign, err := makeJWTSigner(config.Method, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.TTL <= 0 {
+		config.TTL = defaultJWTTTL
+	}
+
+	return &mintedToken{
+		config: config,
+		sign:   sign,
+	}, nil
+}
+
+// Token returns the current token, minting a new one once 80% of its
+// lifetime has passed.
+func (t *mintedToken) Token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.token != "" && now.Before(t.refreshAt) {
+		return t.token, nil
+	}
+
+	if err := t.mint(now); err != nil {
+		return "", err
+	}
+	return t.token, nil
+}
+
+// Refresh mints a new token.
+func (t *mintedToken) Refresh() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.mint(time.Now())
+}
+
+func (t *mintedToken) mint(now time.Time) error {
+	claims := map[string]interface{}{
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(t.config.TTL).Unix(),
+	}
+	for name, value := range map[string]string{
+		"iss":      t.config.Issuer,
+		"sub":      t.config.Subject,
+		"aud":      t.config.Audience,
+		"tenant":   t.config.Tenant,
+		"database": t.config.Database,
+	} {
+		if value != "" {
+			claims[name] = value
+		}
+	}
+
+	header, err := json.Marshal(map[string]string{
+		"alg": t.config.Method,
+		"typ": "JWT",
+	})
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	sig, err := t.sign([]byte(unsigned))
+	if err != nil {
+		return fmt.Errorf("error signing jwt token: %v", err)
+	}
+
+	t.token = unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+	t.refreshAt = now.Add(t.config.TTL * 4 / 5)
+	return nil
+}
+
+// makeJWTSigner returns a function signing data with the key for the given
+// jwt algorithm.  HS256 uses the key file contents as the shared secret,
+// RS256 and ES256 expect a PEM encoded private key.
+func makeJWTSigner(method string, key []byte) (func([]byte) ([]byte, error), error) {
+	switch method {
+	case "HS256":
+		secret := bytes.TrimSpace(key)
+		if len(secret) == 0 {
+			return nil, errors.New("jwt_signing_key_file is empty")
+		}
+		return func(data []byte) ([]byte, error) {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(data)
+			return mac.Sum(nil), nil
+		}, nil
+	case "RS256":
+		priv, err := parsePrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := priv.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("RS256 requires an RSA private key")
+		}
+		return func(data []byte) ([]byte, error) {
+			digest := sha256.Sum256(data)
+			return rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		}, nil
+	case "ES256":
+		priv, err := parsePrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		ecKey, ok := priv.(*ecdsa.PrivateKey)
+		if !ok || ecKey.Curve != elliptic.P256() {
+			return nil, errors.New("ES256 requires a P-256 EC private key")
+		}
+		return func(data []byte) ([]byte, error) {
+			digest := sha256.Sum256(data)
+			r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+			if err != nil {
+				return nil, err
+			}
+			// The signature is the concatenation of r and s, each padded to
+			// the curve size.
+			sig := make([]byte, 64)
+			rb, sb := r.Bytes(), s.Bytes()
+			copy(sig[32-len(rb):32], rb)
+			copy(sig[64-len(sb):], sb)
+			return sig, nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported jwt_signing_method %q", method)
+	}
+}
+
+func parsePrivateKey(data []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("jwt_signing_key_file is not PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key: %v", err)
+	}
+	return key, nil
+}
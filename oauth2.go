@@ -0,0 +1,167 @@
+package orangesys
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultOAuth2RefreshBefore is how long before expiry a cached token is
+	// replaced.
+	defaultOAuth2RefreshBefore = time.Minute
+)
+
+// oauth2Config configures the OAuth2 client credentials grant.
+type oauth2Config struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	Audience     string
+}
+
+// oauth2Token fetches bearer tokens from an OAuth2 token endpoint using the
+// client credentials grant.  Tokens are cached and refreshed shortly before
+// they expire.
+type oauth2Token struct {
+	config *oauth2Config
+	client *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiry    time.Time
+	refreshAt time.Time
+}
+
+// oauth2TokenResponse is the response body from the token endpoint
+type oauth2TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func newOAuth2Token(config *oauth2Config, client *http.Client) (*oauth2Token, error) {
+	if config.TokenURL == "" {
+		return nil, errors.New("missing oauth2_token_url")
+	}
+	if config.ClientID == "" {
+		return nil, errors.New("missing oauth2_client_id")
+	}
+
+	if client == nil {
+		client = &http.Client{Timeout: defaultRequestTimeout}
+	}
+
+	return &oauth2Token{
+		config: config,
+		client: client,
+	}, nil
+}
+
+// Token returns the cached token, fetching a new one when there is none or
+// it is about to expire.  If the refresh fails while the cached token is
+// still valid, the cached token is used.
+func (t *oauth2Token) Token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.token != "" && now.Before(t.refreshAt) {
+		return t.token, nil
+	}
+
+	err := t.fetch(now)
+	if err != nil {
+		if t.token != "" && now.Before(t.expiry) {
+			log.Printf("W! [outputs.orangesys] unable to refresh oauth2 token, using cached token: %v", err)
+			return t.token, nil
+		}
+		return "", err
+	}
+	return t.token, nil
+}
+
+// CloseIdleConnections closes the keep-alive connections to the token
+// endpoint.
+func (t *oauth2Token) CloseIdleConnections() {
+	t.client.CloseIdleConnections()
+}
+
+// Refresh discards the cached token and fetches a new one.
+func (t *oauth2Token) Refresh() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.fetch(time.Now())
+}
+
+func (t *oauth2Token) fetch(now time.Time) error {
+	params := url.Values{}
+	params.Set("grant_type", "client_credentials")
+	if len(t.config.Scopes) > 0 {
+		params.Set("scope", strings.Join(t.config.Scopes, " "))
+	}
+	if t.config.Audience != "" {
+		params.Set("audience", t.config.Audience)
+	}
+
+	req, err := http.NewRequest("POST", t.config.TokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(t.config.ClientID), url.QueryEscape(t.config.ClientSecret))
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error requesting oauth2 token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	tokenResp := &oauth2TokenResponse{}
+	err = json.NewDecoder(resp.Body).Decode(tokenResp)
+
+	if resp.StatusCode != http.StatusOK {
+		desc := tokenResp.Error
+		if tokenResp.ErrorDescription != "" {
+			desc = fmt.Sprintf("%s: %s", desc, tokenResp.ErrorDescription)
+		}
+		return &APIError{
+			StatusCode:  resp.StatusCode,
+			Title:       resp.Status,
+			Description: desc,
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error decoding oauth2 token response: %v", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return errors.New("oauth2 token response has no access_token")
+	}
+
+	t.token = tokenResp.AccessToken
+	if tokenResp.ExpiresIn > 0 {
+		lifetime := time.Duration(tokenResp.ExpiresIn) * time.Second
+		refreshBefore := defaultOAuth2RefreshBefore
+		if refreshBefore > lifetime/2 {
+			refreshBefore = lifetime / 2
+		}
+		t.expiry = now.Add(lifetime)
+		t.refreshAt = t.expiry.Add(-refreshBefore)
+	} else {
+		// Without expires_in the token is used until the server rejects it.
+		t.expiry = time.Time{}
+		t.refreshAt = now.Add(24 * 365 * time.Hour)
+	}
+	return nil
+}
@@ -5,8 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"math/rand"
+	"net"
+	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/influxdata/telegraf"
@@ -16,6 +18,11 @@ import (
 	"github.com/influxdata/telegraf/plugins/serializers/influx"
 )
 
+const (
+	defaultShutdownTimeout = 5 * time.Second
+	defaultBatchIDHeader   = "X-Request-Id"
+)
+
 var (
 	defaultURL = "http://localhost:8086"
 
@@ -27,11 +34,34 @@ var (
 type Client interface {
 	Write(context.Context, []telegraf.Metric) error
 	CreateDatabase(ctx context.Context) error
+	Ping(ctx context.Context) error
+
+	// CloseIdleConnections closes keep-alive connections that are not in
+	// use.
+	CloseIdleConnections()
 
 	URL() string
 	Database() string
 }
 
+// namedDatabaseCreator is implemented by clients that can create databases
+// other than their own, which metrics may be routed to.
+type namedDatabaseCreator interface {
+	CreateDatabaseNamed(ctx context.Context, database string) error
+}
+
+// createDatabase creates the database with the client, using
+// CreateDatabaseNamed for databases other than its own.
+func createDatabase(ctx context.Context, client Client, database string) error {
+	if database == "" || database == client.Database() {
+		return client.CreateDatabase(ctx)
+	}
+	if c, ok := client.(namedDatabaseCreator); ok {
+		return c.CreateDatabaseNamed(ctx, database)
+	}
+	return fmt.Errorf("creating database %q is not supported by the client", database)
+}
+
 // Orangesys struct is the primary data structure for the plugin
 type Orangesys struct {
 	// URL is only for backwards compatability
@@ -39,7 +69,21 @@ type Orangesys struct {
 	URLs                 []string `toml:"urls"`
 	Username             string
 	Password             string
-	JwtToken             string `toml:"jwt_token"`
+	JwtToken             string              `toml:"jwt_token"`
+	JwtTokenFile         string              `toml:"jwt_token_file"`
+	JwtExpiryWarnings    []internal.Duration `toml:"jwt_expiry_warnings"`
+	JwtSigningMethod     string              `toml:"jwt_signing_method"`
+	JwtSigningKeyFile    string              `toml:"jwt_signing_key_file"`
+	JwtIssuer            string              `toml:"jwt_issuer"`
+	JwtSubject           string              `toml:"jwt_subject"`
+	JwtAudience          string              `toml:"jwt_audience"`
+	JwtTenant            string              `toml:"jwt_tenant"`
+	JwtTTL               internal.Duration   `toml:"jwt_ttl"`
+	OAuth2TokenURL       string              `toml:"oauth2_token_url"`
+	OAuth2ClientID       string              `toml:"oauth2_client_id"`
+	OAuth2ClientSecret   string              `toml:"oauth2_client_secret"`
+	OAuth2Scopes         []string            `toml:"oauth2_scopes"`
+	OAuth2Audience       string              `toml:"oauth2_audience"`
 	Database             string
 	UserAgent            string
 	RetentionPolicy      string
@@ -51,23 +95,122 @@ type Orangesys struct {
 	ContentEncoding      string            `toml:"content_encoding"`
 	SkipDatabaseCreation bool              `toml:"skip_database_creation"`
 	InfluxUintSupport    bool              `toml:"influx_uint_support"`
+	Endpoints            []*Endpoint       `toml:"endpoint"`
+	DatabaseTag          string            `toml:"database_tag"`
+	ExcludeDatabaseTag   bool              `toml:"exclude_database_tag"`
+	DatabaseRules        []*DatabaseRule   `toml:"database_rule"`
+
+	// Select the retention policy of each metric
+	RetentionPolicyTag        string                 `toml:"retention_policy_tag"`
+	ExcludeRetentionPolicyTag bool                   `toml:"exclude_retention_policy_tag"`
+	RetentionPolicyRules      []*RetentionPolicyRule `toml:"retention_policy_rule"`
 	tls.ClientConfig
 
-	// Path to CA file
+	// Path to CA file, deprecated in favor of tls_ca
 	SSLCA string `toml:"ssl_ca"`
-	// Path to host cert file
+	// Path to host cert file, deprecated in favor of tls_cert
 	SSLCert string `toml:"ssl_cert"`
-	// Path to cert key file
+	// Path to cert key file, deprecated in favor of tls_key
 	SSLKey string `toml:"ssl_key"`
 	// Use SSL but skip chain & host verification
 	InsecureSkipVerify bool
 
+	// Sign requests with HMAC-SHA256
+	SigningKey             string `toml:"signing_key"`
+	SigningSignatureHeader string `toml:"signing_signature_header"`
+	SigningTimestampHeader string `toml:"signing_timestamp_header"`
+
+	// Retry failed writes with exponential backoff
+	RetryMaxAttempts     int               `toml:"retry_max_attempts"`
+	RetryInitialInterval internal.Duration `toml:"retry_initial_interval"`
+	RetryMaxInterval     internal.Duration `toml:"retry_max_interval"`
+	RetryMaxElapsedTime  internal.Duration `toml:"retry_max_elapsed_time"`
+
+	// Skip endpoints after consecutive failures
+	CircuitBreakerFailureThreshold int               `toml:"circuit_breaker_failure_threshold"`
+	CircuitBreakerSuccessThreshold int               `toml:"circuit_breaker_success_threshold"`
+	CircuitBreakerCooldown         internal.Duration `toml:"circuit_breaker_cooldown"`
+
+	// Ping endpoints in the background, 0 disables the checks
+	HealthCheckInterval internal.Duration `toml:"health_check_interval"`
+
+	// Persist batches that could not be written to disk
+	QueueDir      string `toml:"queue_dir"`
+	QueueMaxBytes int64  `toml:"queue_max_bytes"`
+	QueueEviction string `toml:"queue_eviction"`
+	QueueFsync    string `toml:"queue_fsync"`
+
+	// Batches replayed from the disk queue by each write
+	QueueReplayBatches int `toml:"queue_replay_batches"`
+
+	// Keep metrics rejected by the server in local files
+	DeadLetterDir         string `toml:"dead_letter_dir"`
+	DeadLetterMaxFileSize int64  `toml:"dead_letter_max_file_size"`
+	DeadLetterMaxFiles    int    `toml:"dead_letter_max_files"`
+
+	// Time Close waits for in-flight writes before cancelling them
+	ShutdownTimeout internal.Duration `toml:"shutdown_timeout"`
+
+	// Header carrying the batch ID used for deduplication
+	BatchIDHeader string `toml:"batch_id_header"`
+
+	// How writes are spread over the servers
+	WriteStrategy string             `toml:"write_strategy"`
+	WriteQuorum   int                `toml:"write_quorum"`
+	URLWeights    map[string]float64 `toml:"url_weights"`
+
+	// Spread series over the servers with a consistent hash
+	ShardTags         []string `toml:"shard_tags"`
+	ShardVirtualNodes int      `toml:"shard_virtual_nodes"`
+
+	// Interval at which srv+http and srv+https urls are resolved again
+	SRVRefreshInterval internal.Duration `toml:"srv_refresh_interval"`
+
 	// Precision is only here for legacy support. It will be ignored.
 	Precision string
 
-	clients []Client
+	clients       []Client
+	tokenSource   TokenSource
+	authenticator Authenticator
+	headers       map[string]string
+	tokenChecks   []*tokenCheck
+	mintConfig    *jwtMintConfig
+	signer        *RequestSigner
+	retry         *retryPolicy
+	health        *healthChecker
+	queue         *diskQueue
+	deadLetter    *deadLetterSink
+
+	// tokensMu guards the tokens minted for the databases of endpoints
+	// and the jwt_token values in use, which endpoints discovered later
+	// share.  checksMu guards tokenChecks.
+	tokensMu     sync.Mutex
+	mintedTokens map[string]TokenSource
+	userTokens   map[string]TokenSource
+	checksMu     sync.Mutex
+
+	// ctx is cancelled by Close to abort in-flight writes.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	inflight sync.WaitGroup
+
+	// mu guards the clients and their state, which change when endpoints
+	// are discovered.  Writes hold the read lock.
+	mu         sync.RWMutex
+	members    []*member
+	roundRobin uint32
+	weights    []float64
+	priorities []int
+	srvWeights []float64
+	stats      []*endpointStats
+	ring       *hashRing
+
+	discovery       bool
+	discoveryCancel context.CancelFunc
+	discoveryWG     sync.WaitGroup
 
 	CreateHTTPClientF func(config *HTTPConfig) (Client, error)
+	LookupSRVF        func(ctx context.Context, name string) ([]*net.SRV, error)
 
 	serializer *influx.Serializer
 }
@@ -77,63 +220,342 @@ var sampleConfig = `
   database = "telegraf" # required
   jwt_token = "jwt_token" # required
 
+  ## Read the jwt token from a file instead of jwt_token.  The file is
+  ## reloaded whenever it changes, so the token can be rotated without a
+  ## restart.
+  # jwt_token_file = "/etc/telegraf/orangesys.jwt"
+
+  ## Log a warning when the remaining lifetime of the jwt token drops below
+  ## each of these durations.  A token that has already expired is refused.
+  # jwt_expiry_warnings = ["168h", "24h", "1h"]
+
+  ## Mint short-lived jwt tokens locally instead of using jwt_token.  The
+  ## signing method is one of HS256, RS256 or ES256.  HS256 uses the contents
+  ## of the key file as shared secret, RS256 and ES256 a PEM private key.
+  ## The database is sent in the "database" claim, endpoint tables with a
+  ## database of their own and metrics routed by database_tag or
+  ## database_rule get tokens for their database.  A new token is minted
+  ## before the current one expires.
+  # jwt_signing_method = "ES256"
+  # jwt_signing_key_file = "/etc/telegraf/orangesys.key"
+  # jwt_issuer = "telegraf"
+  # jwt_subject = "agent-01"
+  # jwt_audience = "https://<orangesys-url>"
+  # jwt_tenant = "acme"
+  # jwt_ttl = "5m"
+
+  ## Fetch short-lived bearer tokens from an OAuth2 token endpoint using the
+  ## client credentials grant instead of using jwt_token.  Tokens are cached
+  ## and refreshed before they expire.
+  # oauth2_token_url = "https://idp.example.com/oauth2/token"
+  # oauth2_client_id = "telegraf"
+  # oauth2_client_secret = "secret"
+  # oauth2_scopes = ["metrics:write"]
+  # oauth2_audience = "https://<orangesys-url>"
+
+  ## The jwt_token, password and http_headers values may refer to secrets
+  ## stored outside of this file, resolved at startup and again when the
+  ## server rejects the credentials:
+  ##   "env:NAME"      environment variable NAME
+  ##   "file:/path"    contents of the file
+  ##   "exec:command"  output of the command
+  # jwt_token = "file:/run/secrets/orangesys_jwt"
+  # http_headers = {"X-Api-Key" = "env:ORANGESYS_API_KEY"}
+
+  ## Optional TLS Config for use on HTTP connections.  The client
+  ## certificate and key are reloaded when they change on disk.
+  # tls_ca = "/etc/telegraf/ca.pem"
+  # tls_cert = "/etc/telegraf/cert.pem"
+  # tls_key = "/etc/telegraf/key.pem"
+  ## Use TLS but skip chain & host verification
+  # insecure_skip_verify = false
+
   ## Compress each HTTP request payload using GZIP.
   # content_encoding = "gzip"
+
+  ## Sign each request with HMAC-SHA256 over the method, path and query,
+  ## timestamp and body hash.  The key may be a secret reference.
+  # signing_key = "env:ORANGESYS_SIGNING_KEY"
+  # signing_signature_header = "X-Orangesys-Signature"
+  # signing_timestamp_header = "X-Orangesys-Timestamp"
+
+  ## Retry writes that failed on every server with a retryable error, such
+  ## as a timeout, 429 or 5xx response, with exponential backoff and jitter.
+  ## The Retry-After header of 429 and 503 responses is honored.  Retries
+  ## stop after max_attempts or once max_elapsed_time would be exceeded.
+  # retry_max_attempts = 3
+  # retry_initial_interval = "500ms"
+  # retry_max_interval = "10s"
+  # retry_max_elapsed_time = "30s"
+
+  ## Stop writing to a server for the cool-down period after it failed this
+  ## many consecutive times.  After the cool-down a single write probes the
+  ## server, which is used again after success_threshold successful probes.
+  ## Set failure_threshold to 0 to disable.
+  # circuit_breaker_failure_threshold = 5
+  # circuit_breaker_success_threshold = 1
+  # circuit_breaker_cooldown = "30s"
+
+  ## Ping every server at this interval in the background.  Writes go to
+  ## servers that answered the last ping first.  Set to "0s" to disable.
+  # health_check_interval = "30s"
+
+  ## Store batches that could not be written to any server in a queue on
+  ## disk, as line protocol, and replay them in order once a server is
+  ## available again.  The queue survives restarts.  When it grows beyond
+  ## queue_max_bytes, the queue_eviction policy either drops the oldest
+  ## batches ("drop_oldest") or refuses new ones ("drop_newest").  With
+  ## queue_fsync = "always" each batch is synced to disk before the write
+  ## is acknowledged, "never" leaves it to the operating system.
+  # queue_dir = "/var/lib/telegraf/orangesys-queue"
+  # queue_max_bytes = 1073741824
+  # queue_eviction = "drop_oldest"
+  # queue_fsync = "always"
+
+  ## Replay at most this many queued batches on each write, so a write
+  ## after a long outage does not take minutes.  New metrics are added to
+  ## the queue behind the batches still to be replayed.
+  # queue_replay_batches = 10
+
+  ## Keep metrics rejected by the server, for example because of a field
+  ## type conflict, in files in this directory instead of discarding them.
+  ## Each file of line protocol has a JSON sidecar describing why every
+  ## metric was rejected.  A new file is started when the current one
+  ## reaches dead_letter_max_file_size bytes, and the oldest files are
+  ## removed beyond dead_letter_max_files.  Use the orangesys-deadletter
+  ## command to send the metrics again.
+  # dead_letter_dir = "/var/lib/telegraf/orangesys-deadletter"
+  # dead_letter_max_file_size = 10485760
+  # dead_letter_max_files = 10
+
+  ## On shutdown or reload, wait this long for in-flight writes to finish
+  ## before they are cancelled.  With queue_dir set, cancelled batches are
+  ## stored in the disk queue.
+  # shutdown_timeout = "5s"
+
+  ## Send a batch ID with every write in this header, so the server can
+  ## deduplicate writes that were retried after they had landed.  The ID
+  ## is a hash of the metrics and stays the same on retries, on failover to
+  ## another server and after replay from the disk queue.  Set to "" to
+  ## disable.
+  # batch_id_header = "X-Request-Id"
+
+  ## How writes are spread over the servers:
+  ##   random      - try the servers in random order until one succeeds
+  ##   round_robin - start with the next server on every write
+  ##   failover    - try the servers in the order they are configured, so
+  ##                 the first one is used whenever it is available
+  ##   broadcast   - write to all servers at once, succeeding when at least
+  ##                 write_quorum of them succeed (0 means all)
+  ##   weighted    - prefer servers by their weight divided by the moving
+  ##                 average of their write latency, reduced by their error
+  ##                 rate; every server still receives some writes
+  ##   shard       - split each batch by series, and write each series to
+  ##                 the server owning it on a consistent hash ring; when
+  ##                 that server is down the next one on the ring is used
+  # write_strategy = "random"
+  # write_quorum = 0
+
+  ## The series of the shard strategy is the measurement name and the
+  ## values of these tags.  Each server is placed on the ring this many
+  ## times to spread the series evenly.
+  # shard_tags = ["host"]
+  # shard_virtual_nodes = 128
+
+  ## Urls such as "srv+https://_orangesys._tcp.example.com" are resolved to
+  ## a server for each DNS SRV record, with the target and port of the
+  ## record.  Servers with a lower priority number are tried first.  Servers
+  ## of the same priority are picked by the weight of their record with the
+  ## random strategy, and the weighted strategy uses the weight in its
+  ## scores; round_robin and failover ignore the weights.  The records
+  ## are looked up again at this interval, adding new servers and removing
+  ## the ones that are gone once their writes have finished.  Set to "0s"
+  ## to only resolve them on startup.
+  # srv_refresh_interval = "30s"
+
+  ## Write each metric to the database named by the value of this tag.
+  ## Metrics without the tag go to the database of the first matching
+  ## database_rule, or else to database.  Databases are created before the
+  ## first write to them unless skip_database_creation is set.
+  # database_tag = ""
+  ## Remove the database_tag from the metrics before writing.
+  # exclude_database_tag = false
+
+  ## Write each metric to the retention policy named by the value of this
+  ## tag.  Metrics without the tag go to the retention policy of the first
+  ## matching retention_policy_rule, or else to retention_policy.  Each
+  ## batch is sent with one request per database and retention policy.
+  # retention_policy_tag = ""
+  ## Remove the retention_policy_tag from the metrics before writing.
+  # exclude_retention_policy_tag = false
+
+  ## Weights of the urls for the weighted strategy, 1 if not set.  Endpoint
+  ## tables set their weight with the weight option.
+  # [outputs.orangesys.url_weights]
+  #   "https://<orangesys-url>" = 10
+  #   "https://<orangesys-dr-url>" = 1
+
+  ## Write measurements matching the regular expression to the database.
+  # [[outputs.orangesys.database_rule]]
+  #   measurement = "^team_a_"
+  #   database = "team_a"
+
+  ## Write measurements matching the regular expression to the retention
+  ## policy.
+  # [[outputs.orangesys.retention_policy_rule]]
+  #   measurement = "^(cpu|mem|disk)$"
+  #   retention_policy = "7d"
+
+  ## Endpoints with their own credentials, database and TLS settings, in
+  ## addition to urls.  Options that are not set use the values above.
+  # [[outputs.orangesys.endpoint]]
+  #   url = "https://<orangesys-dr-url>"
+  #   jwt_token = "env:ORANGESYS_DR_TOKEN"
+  #   database = "telegraf"
+  #   retention_policy = ""
+  #   http_proxy = "http://proxy.example.com:3128"
+  #   tls_server_name = "<orangesys-dr-url>"
+  #   tls_ca = "/etc/telegraf/dr-ca.pem"
+  #   weight = 1.0
+  #   [outputs.orangesys.endpoint.http_headers]
+  #     X-Tenant = "dr"
 `
 
 // Connect initiates the primary connection to the range of provided URLs
 func (i *Orangesys) Connect() error {
-	ctx := context.Background()
+	i.ctx, i.cancel = context.WithCancel(context.Background())
+	ctx := i.ctx
 
-	urls := make([]string, 0, len(i.URLs))
-	urls = append(urls, i.URLs...)
+	i.serializer = i.newSerializer()
 
-	if i.URL != "" {
-		urls = append(urls, i.URL)
-	}
+	i.mapLegacyTLSConfig()
 
-	if len(urls) == 0 {
-		urls = append(urls, defaultURL)
+	if err := i.makeTokenSource(); err != nil {
+		return err
 	}
 
-	i.serializer = influx.NewSerializer()
+	if err := i.compileRoutingRules(); err != nil {
+		return err
+	}
 
-	if i.InfluxUintSupport {
-		i.serializer.SetFieldTypeSupport(influx.UintSupport)
+	authenticator, headers, err := i.makeAuthenticator(i.tokenSource, i.HTTPHeaders)
+	if err != nil {
+		return err
 	}
+	i.authenticator = authenticator
+	i.headers = headers
 
-	for _, u := range urls {
-		u, err := url.Parse(u)
+	if i.SigningKey != "" {
+		key, err := resolveSecret(i.SigningKey)
 		if err != nil {
-			return fmt.Errorf("error parsing url [%s]: %v", u, err)
+			return fmt.Errorf("error resolving signing_key: %v", err)
+		}
+		i.signer = &RequestSigner{
+			Key:             []byte(key),
+			SignatureHeader: i.SigningSignatureHeader,
+			TimestampHeader: i.SigningTimestampHeader,
 		}
+	}
 
-		var proxy *url.URL
-		if len(i.HTTPProxy) > 0 {
-			proxy, err = url.Parse(i.HTTPProxy)
-			if err != nil {
-				return fmt.Errorf("error parsing proxy_url [%s]: %v", proxy, err)
-			}
+	i.retry = &retryPolicy{
+		MaxAttempts:     i.RetryMaxAttempts,
+		InitialInterval: i.RetryInitialInterval.Duration,
+		MaxInterval:     i.RetryMaxInterval.Duration,
+		MaxElapsedTime:  i.RetryMaxElapsedTime.Duration,
+	}
+
+	if i.QueueDir != "" {
+		q, err := openDiskQueue(i.QueueDir, i.QueueMaxBytes, i.QueueEviction, i.QueueFsync)
+		if err != nil {
+			return err
 		}
+		if n := q.Len(); n > 0 {
+			log.Printf("I! [outputs.orangesys] %d batches in disk queue will be replayed", n)
+		}
+		i.queue = q
+	}
 
-		switch u.Scheme {
-		case "http", "https", "unix":
-			c, err := i.httpClient(ctx, u, proxy)
-			if err != nil {
-				return err
-			}
+	if i.DeadLetterDir != "" {
+		s, err := openDeadLetterSink(i.DeadLetterDir, i.DeadLetterMaxFileSize, i.DeadLetterMaxFiles, i.newSerializer())
+		if err != nil {
+			return err
+		}
+		i.deadLetter = s
+	}
 
-			i.clients = append(i.clients, c)
-		default:
-			return fmt.Errorf("unsupport scheme [%s]: %q", u, u.Scheme)
+	for _, ep := range i.endpoints() {
+		if isSRVURL(ep.URL) {
+			i.discovery = true
 		}
 	}
 
+	members, err := i.connectEndpoints(ctx, nil)
+	if err != nil {
+		return err
+	}
+	i.setMembers(members)
+
+	if err := i.checkWriteStrategy(); err != nil {
+		return err
+	}
+
+	if i.HealthCheckInterval.Duration > 0 {
+		i.health = newHealthChecker(i.clients, i.HealthCheckInterval.Duration, i.Timeout.Duration)
+		i.health.Start()
+	}
+
+	if i.discovery && i.SRVRefreshInterval.Duration > 0 {
+		i.startDiscovery()
+	}
+
 	return nil
 }
 
+// newSerializer returns a line protocol serializer.  Serializers are not
+// safe for concurrent use, so every client gets its own.
+func (i *Orangesys) newSerializer() *influx.Serializer {
+	serializer := influx.NewSerializer()
+	if i.InfluxUintSupport {
+		serializer.SetFieldTypeSupport(influx.UintSupport)
+	}
+	return serializer
+}
+
 // Close will terminate the session to the backend, returning error if an issue arises
 func (i *Orangesys) Close() error {
+	i.stopDiscovery()
+
+	if i.health != nil {
+		i.health.Stop()
+	}
+
+	if i.cancel != nil {
+		done := make(chan struct{})
+		go func() {
+			i.inflight.Wait()
+			close(done)
+		}()
+
+		timer := time.NewTimer(i.ShutdownTimeout.Duration)
+		select {
+		case <-done:
+		case <-timer.C:
+			log.Printf("W! [outputs.orangesys] cancelling in-flight writes after %s", i.ShutdownTimeout.Duration)
+			i.cancel()
+			<-done
+		}
+		timer.Stop()
+		i.cancel()
+	}
+
+	i.mu.RLock()
+	for _, c := range i.clients {
+		c.CloseIdleConnections()
+	}
+	i.mu.RUnlock()
+	if c, ok := i.tokenSource.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
 	return nil
 }
 
@@ -148,63 +570,407 @@ func (i *Orangesys) SampleConfig() string {
 }
 
 // Write will choose a random server in the cluster to write to until a successful write
-// occurs, logging each unsuccessful. If all servers fail, return error.
+// occurs, logging each unsuccessful. If all servers fail with a retryable error, the
+// write is attempted again after a backoff according to the retry policy. If it still
+// fails, the batch is stored in the disk queue when one is configured, otherwise return
+// error.
 func (i *Orangesys) Write(metrics []telegraf.Metric) error {
-	ctx := context.Background()
+	i.inflight.Add(1)
+	defer i.inflight.Done()
+
+	ctx := i.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if err := i.checkTokenExpiry(); err != nil {
+		log.Printf("E! [outputs.orangesys]: %v", err)
+	}
+
+	if i.queue != nil {
+		return i.writeQueued(ctx, metrics)
+	}
+
+	_, err := i.writeWithRetry(ctx, metrics)
+	return err
+}
+
+// writeWithRetry writes the metrics, retrying according to the retry
+// policy.  On failure it also returns the errors of the last attempt.
+func (i *Orangesys) writeWithRetry(ctx context.Context, metrics []telegraf.Metric) ([]error, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		errs, err := i.writeRound(ctx, metrics)
+		if err == nil {
+			return nil, nil
+		}
+
+		retryable := anyRetryable(errs)
+		var delay time.Duration
+		for _, e := range errs {
+			if d := retryAfter(e); d > delay {
+				delay = d
+			}
+		}
+
+		if !retryable || attempt >= i.retry.MaxAttempts {
+			return errs, err
+		}
 
-	var err error
-	p := rand.Perm(len(i.clients))
+		if d := i.retry.backoff(attempt); d > delay {
+			delay = d
+		}
+		if i.retry.MaxElapsedTime > 0 && time.Since(start)+delay > i.retry.MaxElapsedTime {
+			return errs, err
+		}
+
+		log.Printf("D! [outputs.orangesys] retrying write in %s (attempt %d of %d)",
+			delay, attempt+1, i.retry.MaxAttempts)
+		if err := sleep(ctx, delay); err != nil {
+			return errs, err
+		}
+	}
+}
+
+// writeRound writes the metrics once according to the write strategy.  On
+// failure it returns the errors of each client along with the error to
+// report.
+func (i *Orangesys) writeRound(ctx context.Context, metrics []telegraf.Metric) ([]error, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if len(i.clients) == 0 {
+		err := errors.New("no servers to write to")
+		return []error{err}, err
+	}
+
+	switch i.WriteStrategy {
+	case writeStrategyBroadcast:
+		return i.writeBroadcast(ctx, metrics)
+	case writeStrategyShard:
+		return i.writeSharded(ctx, metrics)
+	}
+	return i.writeOrdered(ctx, metrics, i.writeOrder())
+}
 
-	for _, n := range p {
+// writeOrdered tries each client once in the order given until a write
+// succeeds.
+func (i *Orangesys) writeOrdered(ctx context.Context, metrics []telegraf.Metric, order []int) ([]error, error) {
+	var errs []error
+	var authErr error
+	for _, n := range order {
 		client := i.clients[n]
-		err = client.Write(ctx, metrics)
+		start := time.Now()
+		err := client.Write(ctx, metrics)
+		i.observe(n, time.Since(start), err)
 		if err == nil {
-			return nil
+			return nil, nil
 		}
+		errs = append(errs, err)
 
 		switch apiError := err.(type) {
 		case *APIError:
-			if !i.SkipDatabaseCreation {
-				if apiError.Type == DatabaseNotFound {
-					err := client.CreateDatabase(ctx)
-					if err != nil {
-						log.Printf("E! [outputs.orangesys] when write to [%s]: database %q not found and failed to recreate",
-							client.URL(), client.Database())
-					}
-				}
+			i.recreateDatabase(ctx, client, apiError)
+		case *PartialWriteError:
+			// The rest of the batch was written, the rejected metrics
+			// would be rejected by every server.
+			i.partialWrite(client, apiError)
+			return nil, nil
+		case *CircuitOpenError:
+			log.Printf("D! [outputs.orangesys]: skipping [%s]: %v", client.URL(), err)
+			continue
+		case *TokenExpiredError:
+			authErr = apiError
+		case *AuthError:
+			// Access to the database is denied, writing to another
+			// server will not help.
+			if apiError.StatusCode == http.StatusForbidden {
+				return []error{apiError}, apiError
 			}
+			authErr = apiError
 		}
 		log.Printf("E! [outputs.influxdb]: when writing to [%s]: %v", client.URL(), err)
 	}
-	return errors.New("cloud not write any address")
+
+	if authErr != nil {
+		return errs, authErr
+	}
+	return errs, errors.New("cloud not write any address")
 }
 
-func (i *Orangesys) httpClient(ctx context.Context, url *url.URL, proxy *url.URL) (Client, error) {
-	tlsConfig, err := i.ClientConfig.TLSConfig()
+// recreateDatabase creates the database again after the server reported
+// that it does not exist.
+func (i *Orangesys) recreateDatabase(ctx context.Context, client Client, apiError *APIError) {
+	if i.SkipDatabaseCreation || apiError.Type != DatabaseNotFound {
+		return
+	}
+
+	database := apiError.Database
+	err := createDatabase(ctx, client, database)
+	if err != nil {
+		if database == "" {
+			database = client.Database()
+		}
+		log.Printf("E! [outputs.orangesys] when write to [%s]: database %q not found and failed to recreate",
+			client.URL(), database)
+	}
+}
+
+// partialWrite reports the metrics rejected by the server and keeps them
+// in the dead letter files.
+func (i *Orangesys) partialWrite(client Client, err *PartialWriteError) {
+	log.Printf("W! [outputs.orangesys]: %v", err)
+	for _, r := range err.Rejected {
+		log.Printf("D! [outputs.orangesys]: rejected metric %q: %s", r.Metric.Name(), r.Reason)
+	}
+	if i.deadLetter != nil {
+		if err := i.deadLetter.Write(client, err); err != nil {
+			log.Printf("E! [outputs.orangesys]: could not write rejected metrics to dead letter files: %v", err)
+		}
+	}
+}
+
+// makeTokenSource selects where the bearer token comes from.  Only tokens
+// configured by the user are checked for expiry, tokens minted locally or
+// fetched with OAuth2 are refreshed automatically.
+func (i *Orangesys) makeTokenSource() error {
+	configured := 0
+	for _, v := range []string{i.JwtToken, i.JwtTokenFile, i.JwtSigningKeyFile, i.OAuth2TokenURL} {
+		if v != "" {
+			configured++
+		}
+	}
+	if configured > 1 {
+		return errors.New("jwt_token, jwt_token_file, jwt_signing_key_file and oauth2_token_url are mutually exclusive")
+	}
+
+	switch {
+	case i.JwtTokenFile != "":
+		t, err := newFileToken(i.JwtTokenFile)
+		if err != nil {
+			return err
+		}
+		if err := i.addTokenCheck(t); err != nil {
+			return err
+		}
+		i.tokenSource = t
+	case i.JwtSigningKeyFile != "":
+		database := i.Database
+		if database == "" {
+			database = defaultDatabase
+		}
+		i.mintConfig = &jwtMintConfig{
+			Method:   i.JwtSigningMethod,
+			KeyFile:  i.JwtSigningKeyFile,
+			Issuer:   i.JwtIssuer,
+			Subject:  i.JwtSubject,
+			Audience: i.JwtAudience,
+			Tenant:   i.JwtTenant,
+			Database: database,
+			TTL:      i.JwtTTL.Duration,
+		}
+		t, err := i.mintedToken(database)
+		if err != nil {
+			return err
+		}
+		i.tokenSource = t
+		return nil
+	case i.OAuth2TokenURL != "":
+		tlsConfig, err := i.tlsConfig(nil)
+		if err != nil {
+			return err
+		}
+		proxy := http.ProxyFromEnvironment
+		if i.HTTPProxy != "" {
+			proxyURL, err := url.Parse(i.HTTPProxy)
+			if err != nil {
+				return fmt.Errorf("error parsing proxy_url [%s]: %v", i.HTTPProxy, err)
+			}
+			proxy = http.ProxyURL(proxyURL)
+		}
+		client := &http.Client{
+			Timeout: i.Timeout.Duration,
+			Transport: &http.Transport{
+				Proxy:           proxy,
+				TLSClientConfig: tlsConfig,
+			},
+		}
+		t, err := newOAuth2Token(&oauth2Config{
+			TokenURL:     i.OAuth2TokenURL,
+			ClientID:     i.OAuth2ClientID,
+			ClientSecret: i.OAuth2ClientSecret,
+			Scopes:       i.OAuth2Scopes,
+			Audience:     i.OAuth2Audience,
+		}, client)
+		if err != nil {
+			return err
+		}
+		if _, err := t.Token(); err != nil {
+			return err
+		}
+		i.tokenSource = t
+		return nil
+	case i.JwtToken != "":
+		t, err := i.userToken("jwt_token", i.JwtToken)
+		if err != nil {
+			return err
+		}
+		i.tokenSource = t
+	}
+	return nil
+}
+
+// mintedToken returns the TokenSource minting tokens with the database in
+// their database claim, creating it the first time the database is used.
+func (i *Orangesys) mintedToken(database string) (TokenSource, error) {
+	i.tokensMu.Lock()
+	defer i.tokensMu.Unlock()
+
+	if t, ok := i.mintedTokens[database]; ok {
+		return t, nil
+	}
+
+	config := *i.mintConfig
+	config.Database = database
+	t, err := newMintedToken(&config)
 	if err != nil {
 		return nil, err
 	}
 
-	config := &HTTPConfig{
-		URL:             url,
-		Timeout:         i.Timeout.Duration,
-		TLSConfig:       tlsConfig,
-		UserAgent:       i.UserAgent,
-		Username:        i.Username,
-		Password:        i.Password,
-		Proxy:           proxy,
-		ContentEncoding: i.ContentEncoding,
-		Headers:         i.HTTPHeaders,
-		Database:        i.Database,
-		JwtToken:        i.JwtToken,
-		RetentionPolicy: i.RetentionPolicy,
-		Consistency:     i.WriteConsistency,
-		Serializer:      i.serializer,
+	if i.mintedTokens == nil {
+		i.mintedTokens = make(map[string]TokenSource)
 	}
+	i.mintedTokens[database] = t
+	return t, nil
+}
 
+// userToken returns the TokenSource for a jwt_token option, which may be a
+// secret reference.  The token is checked for expiry when connecting and
+// on every write.  Each value has a single TokenSource, so endpoints
+// created when SRV records change do not add checks.
+func (i *Orangesys) userToken(option, value string) (TokenSource, error) {
+	i.tokensMu.Lock()
+	defer i.tokensMu.Unlock()
+
+	if source, ok := i.userTokens[value]; ok {
+		return source, nil
+	}
+
+	var source TokenSource = staticToken(value)
+	if isSecretRef(value) {
+		s, err := newSecret(value)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving %s: %v", option, err)
+		}
+		source = s
+	}
+
+	if err := i.addTokenCheck(source); err != nil {
+		return nil, err
+	}
+
+	if i.userTokens == nil {
+		i.userTokens = make(map[string]TokenSource)
+	}
+	i.userTokens[value] = source
+	return source, nil
+}
+
+// addTokenCheck checks the token for expiry and registers it to be checked
+// again on every write.
+func (i *Orangesys) addTokenCheck(source TokenSource) error {
+	thresholds := make([]time.Duration, 0, len(i.JwtExpiryWarnings))
+	for _, d := range i.JwtExpiryWarnings {
+		thresholds = append(thresholds, d.Duration)
+	}
+
+	check := &tokenCheck{
+		source: source,
+		warner: newExpiryWarner(thresholds),
+	}
+	if err := check.Check(); err != nil {
+		return err
+	}
+
+	i.checksMu.Lock()
+	i.tokenChecks = append(i.tokenChecks, check)
+	i.checksMu.Unlock()
+	return nil
+}
+
+// checkTokenExpiry warns about tokens that are about to expire and returns
+// an error if one already has.
+func (i *Orangesys) checkTokenExpiry() error {
+	i.checksMu.Lock()
+	checks := i.tokenChecks
+	i.checksMu.Unlock()
+
+	for _, check := range checks {
+		if err := check.Check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeAuthenticator sets up the credentials for a token source and set of
+// headers.  Basic auth is used when a username or password is configured
+// without a token.  Secret references in the password and headers are
+// resolved here, and again when a server rejects the credentials.  It
+// returns the headers that are not secret references.
+func (i *Orangesys) makeAuthenticator(tokenSource TokenSource, httpHeaders map[string]string) (Authenticator, map[string]string, error) {
+	var headers map[string]string
+	var secretHeaders map[string]*secret
+	if httpHeaders != nil {
+		headers = make(map[string]string, len(httpHeaders))
+	}
+	for header, value := range httpHeaders {
+		if !isSecretRef(value) {
+			headers[header] = value
+			continue
+		}
+
+		s, err := newSecret(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error resolving http_headers %q: %v", header, err)
+		}
+		if secretHeaders == nil {
+			secretHeaders = make(map[string]*secret)
+		}
+		secretHeaders[header] = s
+	}
+
+	var next Authenticator
+	var password *secret
+	switch {
+	case tokenSource != nil:
+		next = NewBearerAuthenticator(tokenSource)
+	case isSecretRef(i.Password):
+		s, err := newSecret(i.Password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error resolving password: %v", err)
+		}
+		password = s
+	case i.Username != "" || i.Password != "":
+		next = NewBasicAuthenticator(i.Username, i.Password)
+	}
+
+	if password == nil && secretHeaders == nil {
+		return next, headers, nil
+	}
+
+	return &secretAuthenticator{
+		next:     next,
+		username: i.Username,
+		password: password,
+		headers:  secretHeaders,
+	}, headers, nil
+}
+
+func (i *Orangesys) httpClient(ctx context.Context, config *HTTPConfig) (Client, error) {
 	c, err := i.CreateHTTPClientF(config)
 	if err != nil {
-		return nil, fmt.Errorf("error creating HTTP client [%s]: %v", url, err)
+		return nil, fmt.Errorf("error creating HTTP client [%s]: %v", config.URL, err)
 	}
 
 	if !i.SkipDatabaseCreation {
@@ -220,7 +986,23 @@ func (i *Orangesys) httpClient(ctx context.Context, url *url.URL, proxy *url.URL
 
 func newInflux() *Orangesys {
 	return &Orangesys{
-		Timeout: internal.Duration{Duration: time.Second * 5},
+		Timeout:                        internal.Duration{Duration: time.Second * 5},
+		RetryMaxAttempts:               defaultRetryMaxAttempts,
+		RetryInitialInterval:           internal.Duration{Duration: defaultRetryInitialInterval},
+		RetryMaxInterval:               internal.Duration{Duration: defaultRetryMaxInterval},
+		RetryMaxElapsedTime:            internal.Duration{Duration: defaultRetryMaxElapsedTime},
+		CircuitBreakerFailureThreshold: defaultBreakerFailureThreshold,
+		CircuitBreakerSuccessThreshold: defaultBreakerSuccessThreshold,
+		CircuitBreakerCooldown:         internal.Duration{Duration: defaultBreakerCooldown},
+		HealthCheckInterval:            internal.Duration{Duration: defaultHealthCheckInterval},
+		ShutdownTimeout:                internal.Duration{Duration: defaultShutdownTimeout},
+		BatchIDHeader:                  defaultBatchIDHeader,
+		SRVRefreshInterval:             internal.Duration{Duration: defaultSRVRefreshInterval},
+		JwtExpiryWarnings: []internal.Duration{
+			{Duration: 7 * 24 * time.Hour},
+			{Duration: 24 * time.Hour},
+			{Duration: time.Hour},
+		},
 		CreateHTTPClientF: func(config *HTTPConfig) (Client, error) {
 			return NewHTTPClient(config)
 		},
@@ -2,7 +2,29 @@ package orangesys_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,6 +41,9 @@ type MockClient struct {
 	DatabaseF       func() string
 	WriteF          func(context.Context, []telegraf.Metric) error
 	CreateDatabaseF func(ctx context.Context) error
+	PingF           func(ctx context.Context) error
+
+	CloseIdleConnectionsF func()
 }
 
 func (c *MockClient) URL() string {
@@ -37,6 +62,16 @@ func (c *MockClient) CreateDatabase(ctx context.Context) error {
 	return c.CreateDatabaseF(ctx)
 }
 
+func (c *MockClient) Ping(ctx context.Context) error {
+	return c.PingF(ctx)
+}
+
+func (c *MockClient) CloseIdleConnections() {
+	if c.CloseIdleConnectionsF != nil {
+		c.CloseIdleConnectionsF()
+	}
+}
+
 func TestDefaultURL(t *testing.T) {
 	var actual *orangesys.HTTPConfig
 	output := orangesys.Orangesys{
@@ -106,12 +141,14 @@ func TestConnectHTTPConfig(t *testing.T) {
 }
 
 func TestWriteRecreateDatabaseIfDatabaseNotFound(t *testing.T) {
+	var created int
 	output := orangesys.Orangesys{
 		URLs: []string{"http://localhost:8086"},
 
 		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
 			return &MockClient{
 				CreateDatabaseF: func(ctx context.Context) error {
+					created++
 					return nil
 				},
 				WriteF: func(ctx context.Context, metrics []telegraf.Metric) error {
@@ -147,4 +184,1799 @@ func TestWriteRecreateDatabaseIfDatabaseNotFound(t *testing.T) {
 	err = output.Write(metrics)
 	// We only have one URL, so we expect an error
 	require.Error(t, err)
+	require.Equal(t, 2, created)
+}
+
+func TestWriteReloadsJwtTokenFile(t *testing.T) {
+	var authorization string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "orangesys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("first\n"), 0600))
+
+	output := orangesys.Orangesys{
+		URLs:                 []string{ts.URL},
+		JwtTokenFile:         tokenFile,
+		SkipDatabaseCreation: true,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	m, err := metric.New(
+		"cpu",
+		map[string]string{},
+		map[string]interface{}{
+			"value": 42.0,
+		},
+		time.Unix(0, 0),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, output.Write([]telegraf.Metric{m}))
+	require.Equal(t, "Bearer first", authorization)
+
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("second-token\n"), 0600))
+
+	require.NoError(t, output.Write([]telegraf.Metric{m}))
+	require.Equal(t, "Bearer second-token", authorization)
+}
+
+func makeTestJWT(t *testing.T, claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".c2lnbmF0dXJl"
+}
+
+func TestConnectRefusesExpiredJwtToken(t *testing.T) {
+	output := orangesys.Orangesys{
+		URLs:     []string{"http://localhost:8086"},
+		JwtToken: makeTestJWT(t, map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}),
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return &MockClient{
+				CreateDatabaseF: func(ctx context.Context) error {
+					return nil
+				},
+			}, nil
+		},
+	}
+	err := output.Connect()
+	require.Error(t, err)
+	require.IsType(t, &orangesys.TokenExpiredError{}, err)
+}
+
+func TestWriteReturnsTokenExpiredErrorOnUnauthorized(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	exp := time.Now().Add(-time.Hour).Truncate(time.Second)
+	client, err := orangesys.NewHTTPClient(&orangesys.HTTPConfig{
+		URL:      mustParseURL(t, ts.URL),
+		JwtToken: makeTestJWT(t, map[string]interface{}{"exp": exp.Unix()}),
+	})
+	require.NoError(t, err)
+
+	m, err := metric.New(
+		"cpu",
+		map[string]string{},
+		map[string]interface{}{
+			"value": 42.0,
+		},
+		time.Unix(0, 0),
+	)
+	require.NoError(t, err)
+
+	err = client.Write(context.Background(), []telegraf.Metric{m})
+	require.Error(t, err)
+	expired, ok := err.(*orangesys.TokenExpiredError)
+	require.True(t, ok)
+	require.Equal(t, ts.URL, expired.URL)
+	require.True(t, expired.ExpiredAt.Equal(exp))
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	require.NoError(t, err)
+	return u
+}
+
+func TestWriteUsesOAuth2ClientCredentialsToken(t *testing.T) {
+	var fetches int
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		id, secret, ok := r.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "telegraf", id)
+		require.Equal(t, "s3cret", secret)
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		require.Equal(t, "metrics:write metrics:read", r.PostForm.Get("scope"))
+		require.Equal(t, "orangesys", r.PostForm.Get("audience"))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"short-lived","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer idp.Close()
+
+	var authorization string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	output := orangesys.Orangesys{
+		URLs:                 []string{ts.URL},
+		OAuth2TokenURL:       idp.URL,
+		OAuth2ClientID:       "telegraf",
+		OAuth2ClientSecret:   "s3cret",
+		OAuth2Scopes:         []string{"metrics:write", "metrics:read"},
+		OAuth2Audience:       "orangesys",
+		SkipDatabaseCreation: true,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	m, err := metric.New(
+		"cpu",
+		map[string]string{},
+		map[string]interface{}{
+			"value": 42.0,
+		},
+		time.Unix(0, 0),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, output.Write([]telegraf.Metric{m}))
+	require.NoError(t, output.Write([]telegraf.Metric{m}))
+	require.Equal(t, "Bearer short-lived", authorization)
+	require.Equal(t, 1, fetches)
+}
+
+func TestConnectFetchesOAuth2TokenThroughHTTPProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"short-lived","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer proxy.Close()
+
+	output := orangesys.Orangesys{
+		URLs:                 []string{"http://localhost:8086"},
+		HTTPProxy:            proxy.URL,
+		OAuth2TokenURL:       "http://idp.example.internal/oauth2/token",
+		OAuth2ClientID:       "telegraf",
+		OAuth2ClientSecret:   "s3cret",
+		SkipDatabaseCreation: true,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return &MockClient{}, nil
+		},
+	}
+	require.NoError(t, output.Connect())
+	require.Equal(t, []string{"http://idp.example.internal/oauth2/token"}, proxied)
+}
+
+func TestWriteMintsSignedJwtToken(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "orangesys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+
+	var token string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	output := orangesys.Orangesys{
+		URLs:                 []string{ts.URL},
+		Database:             "metrics",
+		JwtSigningMethod:     "ES256",
+		JwtSigningKeyFile:    keyFile,
+		JwtIssuer:            "telegraf",
+		JwtAudience:          "orangesys",
+		JwtTenant:            "acme",
+		JwtTTL:               internal.Duration{Duration: time.Minute},
+		SkipDatabaseCreation: true,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+	require.NoError(t, output.Write(testMetrics(t)))
+
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	require.Len(t, sig, 64)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	require.True(t, ecdsa.Verify(&key.PublicKey, digest[:], r, s))
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	var claims map[string]interface{}
+	require.NoError(t, json.Unmarshal(payload, &claims))
+	require.Equal(t, "telegraf", claims["iss"])
+	require.Equal(t, "orangesys", claims["aud"])
+	require.Equal(t, "acme", claims["tenant"])
+	require.Equal(t, "metrics", claims["database"])
+	require.Equal(t, float64(60), claims["exp"].(float64)-claims["iat"].(float64))
+}
+
+func TestWriteMintsJwtTokenPerEndpointDatabase(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "orangesys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+
+	var mu sync.Mutex
+	claimed := map[string]interface{}{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		parts := strings.Split(token, ".")
+		require.Len(t, parts, 3)
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		require.NoError(t, err)
+		var claims map[string]interface{}
+		require.NoError(t, json.Unmarshal(payload, &claims))
+
+		mu.Lock()
+		claimed[r.URL.Query().Get("db")] = claims["database"]
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	output := orangesys.Orangesys{
+		URLs:              []string{ts.URL},
+		Database:          "metrics",
+		JwtSigningMethod:  "ES256",
+		JwtSigningKeyFile: keyFile,
+		Endpoints: []*orangesys.Endpoint{
+			{URL: ts.URL, Database: "team_a"},
+		},
+		WriteStrategy:        "broadcast",
+		SkipDatabaseCreation: true,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+	require.NoError(t, output.Write(testMetrics(t)))
+	require.Equal(t, map[string]interface{}{"metrics": "metrics", "team_a": "team_a"}, claimed)
+}
+
+func TestWriteMintsJwtTokenPerRoutedDatabase(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "orangesys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+
+	var mu sync.Mutex
+	claimed := map[string]interface{}{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		parts := strings.Split(token, ".")
+		require.Len(t, parts, 3)
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		require.NoError(t, err)
+		var claims map[string]interface{}
+		require.NoError(t, json.Unmarshal(payload, &claims))
+
+		mu.Lock()
+		claimed[r.URL.Query().Get("db")] = claims["database"]
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	output := orangesys.Orangesys{
+		URLs:                 []string{ts.URL},
+		Database:             "metrics",
+		DatabaseTag:          "team",
+		JwtSigningMethod:     "ES256",
+		JwtSigningKeyFile:    keyFile,
+		SkipDatabaseCreation: true,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	routed, err := metric.New(
+		"cpu",
+		map[string]string{"team": "team_a"},
+		map[string]interface{}{"value": 42.0},
+		time.Unix(0, 0),
+	)
+	require.NoError(t, err)
+	require.NoError(t, output.Write(append(testMetrics(t), routed)))
+	require.Equal(t, map[string]interface{}{"metrics": "metrics", "team_a": "team_a"}, claimed)
+}
+
+func TestSecretReferencesResolvedAgainOnUnauthorized(t *testing.T) {
+	var requests int
+	var authorization, apiKey string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		authorization = r.Header.Get("Authorization")
+		apiKey = r.Header.Get("X-Api-Key")
+		if authorization != "Bearer rotated" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "orangesys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "api-key")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("key\n"), 0600))
+
+	require.NoError(t, os.Setenv("ORANGESYS_TEST_TOKEN", "initial"))
+	defer os.Unsetenv("ORANGESYS_TEST_TOKEN")
+
+	output := orangesys.Orangesys{
+		URLs:     []string{ts.URL},
+		JwtToken: "env:ORANGESYS_TEST_TOKEN",
+		HTTPHeaders: map[string]string{
+			"X-Api-Key": "file:" + keyFile,
+		},
+		SkipDatabaseCreation: true,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	require.NoError(t, os.Setenv("ORANGESYS_TEST_TOKEN", "rotated"))
+
+	require.NoError(t, output.Write(testMetrics(t)))
+	require.Equal(t, "Bearer rotated", authorization)
+	require.Equal(t, "key", apiKey)
+	require.Equal(t, 2, requests)
+}
+
+func TestUnchangedSecretReferencesNotRetriedOnUnauthorized(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	require.NoError(t, os.Setenv("ORANGESYS_TEST_PASSWORD", "static"))
+	defer os.Unsetenv("ORANGESYS_TEST_PASSWORD")
+
+	output := orangesys.Orangesys{
+		URLs:                 []string{ts.URL},
+		Username:             "telegraf",
+		Password:             "env:ORANGESYS_TEST_PASSWORD",
+		SkipDatabaseCreation: true,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	require.Error(t, output.Write(testMetrics(t)))
+	require.Equal(t, 1, requests)
+}
+
+func TestWriteFailsFastOnForbidden(t *testing.T) {
+	var requests int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error":"user is not authorized to write to database"}`))
+	})
+	ts1 := httptest.NewServer(handler)
+	defer ts1.Close()
+	ts2 := httptest.NewServer(handler)
+	defer ts2.Close()
+
+	output := orangesys.Orangesys{
+		URLs:                 []string{ts1.URL, ts2.URL},
+		Database:             "metrics",
+		JwtToken:             "jwt_token",
+		SkipDatabaseCreation: true,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	err := output.Write(testMetrics(t))
+	require.Error(t, err)
+	require.IsType(t, &orangesys.AuthError{}, err)
+	require.Contains(t, err.Error(), `"metrics"`)
+	require.Equal(t, 1, requests)
+}
+
+func writeTestKeyPair(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}
+
+func TestConnectLegacySSLConfigReloadsClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orangesys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestKeyPair(t, certFile, keyFile, "first")
+
+	var actual *orangesys.HTTPConfig
+	output := orangesys.Orangesys{
+		URLs:               []string{"https://localhost:8086"},
+		JwtToken:           "jwt_token",
+		SSLCert:            certFile,
+		SSLKey:             keyFile,
+		InsecureSkipVerify: true,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			actual = config
+			return &MockClient{
+				CreateDatabaseF: func(ctx context.Context) error {
+					return nil
+				},
+			}, nil
+		},
+	}
+	require.NoError(t, output.Connect())
+	require.NotNil(t, actual.TLSConfig)
+	require.True(t, actual.TLSConfig.InsecureSkipVerify)
+	require.NotNil(t, actual.TLSConfig.GetClientCertificate)
+
+	commonName := func() string {
+		cert, err := actual.TLSConfig.GetClientCertificate(nil)
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return leaf.Subject.CommonName
+	}
+	require.Equal(t, "first", commonName())
+
+	writeTestKeyPair(t, certFile, keyFile, "second")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+	require.Equal(t, "second", commonName())
+}
+
+func TestConnectEndpoints(t *testing.T) {
+	var actual []*orangesys.HTTPConfig
+	output := orangesys.Orangesys{
+		URLs:            []string{"http://primary:8086"},
+		Database:        "telegraf",
+		RetentionPolicy: "default",
+		JwtToken:        "primary-token",
+		HTTPProxy:       "http://proxy:3128",
+		HTTPHeaders: map[string]string{
+			"X-Tenant": "primary",
+			"X-Agent":  "telegraf",
+		},
+		Endpoints: []*orangesys.Endpoint{
+			{
+				URL:             "https://dr:8086",
+				JwtToken:        "dr-token",
+				Database:        "dr",
+				RetentionPolicy: "autogen",
+				HTTPHeaders: map[string]string{
+					"X-Tenant": "dr",
+				},
+				TLSServerName: "dr.example.com",
+			},
+		},
+		SkipDatabaseCreation: true,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			actual = append(actual, config)
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+	require.Len(t, actual, 2)
+
+	primary, dr := actual[0], actual[1]
+	require.Equal(t, "http://primary:8086", primary.URL.String())
+	require.Equal(t, "telegraf", primary.Database)
+	require.Equal(t, "default", primary.RetentionPolicy)
+	require.Equal(t, "http://proxy:3128", primary.Proxy.String())
+	require.Equal(t, map[string]string{"X-Tenant": "primary", "X-Agent": "telegraf"}, primary.Headers)
+	require.Nil(t, primary.TLSConfig)
+
+	require.Equal(t, "https://dr:8086", dr.URL.String())
+	require.Equal(t, "dr", dr.Database)
+	require.Equal(t, "autogen", dr.RetentionPolicy)
+	require.Equal(t, "http://proxy:3128", dr.Proxy.String())
+	require.Equal(t, map[string]string{"X-Tenant": "dr", "X-Agent": "telegraf"}, dr.Headers)
+	require.Equal(t, "dr.example.com", dr.TLSConfig.ServerName)
+
+	req, err := http.NewRequest("POST", dr.URL.String(), nil)
+	require.NoError(t, err)
+	require.NoError(t, dr.Authenticator.Authenticate(req))
+	require.Equal(t, "Bearer dr-token", req.Header.Get("Authorization"))
+}
+
+func TestWriteRetriesWithBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		responses  []int
+		retryAfter string
+		requests   int
+		err        bool
+	}{
+		{
+			name:      "retry after service unavailable",
+			responses: []int{http.StatusServiceUnavailable, http.StatusNoContent},
+			requests:  2,
+		},
+		{
+			name:      "give up after max attempts",
+			responses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusNoContent},
+			requests:  3,
+			err:       true,
+		},
+		{
+			name:      "bad request is not retried",
+			responses: []int{http.StatusBadRequest, http.StatusNoContent},
+			requests:  1,
+			err:       true,
+		},
+		{
+			name:       "retry after beyond max elapsed time",
+			responses:  []int{http.StatusTooManyRequests, http.StatusNoContent},
+			retryAfter: "3600",
+			requests:   1,
+			err:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.responses[requests]
+				requests++
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(status)
+			}))
+			defer ts.Close()
+
+			output := orangesys.Orangesys{
+				URLs:                 []string{ts.URL},
+				JwtToken:             "jwt_token",
+				SkipDatabaseCreation: true,
+				RetryMaxAttempts:     3,
+				RetryInitialInterval: internal.Duration{Duration: time.Millisecond},
+				RetryMaxInterval:     internal.Duration{Duration: 10 * time.Millisecond},
+				RetryMaxElapsedTime:  internal.Duration{Duration: time.Second},
+				CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+					return orangesys.NewHTTPClient(config)
+				},
+			}
+			require.NoError(t, output.Connect())
+
+			err := output.Write(testMetrics(t))
+			if tt.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.requests, requests)
+		})
+	}
+}
+
+func TestWriteSkipsEndpointWithOpenCircuitBreaker(t *testing.T) {
+	writes := map[string]int{}
+	output := orangesys.Orangesys{
+		URLs:                           []string{"http://dead:8086", "http://alive:8086"},
+		SkipDatabaseCreation:           true,
+		CircuitBreakerFailureThreshold: 2,
+		CircuitBreakerCooldown:         internal.Duration{Duration: time.Hour},
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			u := config.URL.String()
+			return &MockClient{
+				URLF: func() string {
+					return u
+				},
+				WriteF: func(ctx context.Context, metrics []telegraf.Metric) error {
+					writes[u]++
+					if u == "http://dead:8086" {
+						return errors.New("connection refused")
+					}
+					return nil
+				},
+			}, nil
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	for n := 0; n < 20; n++ {
+		require.NoError(t, output.Write(testMetrics(t)))
+	}
+	require.Equal(t, 20, writes["http://alive:8086"])
+	require.True(t, writes["http://dead:8086"] <= 2)
+}
+
+func TestWritePrefersHealthyEndpoints(t *testing.T) {
+	var mu sync.Mutex
+	pinged := map[string]int{}
+	writes := map[string]int{}
+	output := orangesys.Orangesys{
+		URLs:                 []string{"http://unhealthy:8086", "http://healthy:8086"},
+		SkipDatabaseCreation: true,
+		HealthCheckInterval:  internal.Duration{Duration: 10 * time.Millisecond},
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			u := config.URL.String()
+			return &MockClient{
+				URLF: func() string {
+					return u
+				},
+				PingF: func(ctx context.Context) error {
+					mu.Lock()
+					defer mu.Unlock()
+					pinged[u]++
+					if u == "http://unhealthy:8086" {
+						return errors.New("connection refused")
+					}
+					return nil
+				},
+				WriteF: func(ctx context.Context, metrics []telegraf.Metric) error {
+					writes[u]++
+					return nil
+				},
+			}, nil
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	for {
+		mu.Lock()
+		n := pinged["http://unhealthy:8086"]
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.NoError(t, output.Close())
+
+	for n := 0; n < 10; n++ {
+		require.NoError(t, output.Write(testMetrics(t)))
+	}
+	require.Equal(t, 10, writes["http://healthy:8086"])
+	require.Equal(t, 0, writes["http://unhealthy:8086"])
+}
+
+func TestWriteQueuesBatchesOnDiskUntilServerRecovers(t *testing.T) {
+	var mu sync.Mutex
+	var down bool
+	var received []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		received = append(received, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "orangesys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	newOutput := func() *orangesys.Orangesys {
+		return &orangesys.Orangesys{
+			URLs:                 []string{ts.URL},
+			JwtToken:             "jwt_token",
+			SkipDatabaseCreation: true,
+			QueueDir:             dir,
+			CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+				return orangesys.NewHTTPClient(config)
+			},
+		}
+	}
+
+	newMetric := func(value float64) []telegraf.Metric {
+		m, err := metric.New(
+			"cpu",
+			map[string]string{},
+			map[string]interface{}{
+				"value": value,
+			},
+			time.Unix(0, 0),
+		)
+		require.NoError(t, err)
+		return []telegraf.Metric{m}
+	}
+
+	down = true
+	output := newOutput()
+	require.NoError(t, output.Connect())
+	require.NoError(t, output.Write(newMetric(1)))
+	require.NoError(t, output.Write(newMetric(2)))
+	require.NoError(t, output.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.lp"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+
+	output = newOutput()
+	require.NoError(t, output.Connect())
+	require.NoError(t, output.Write(newMetric(3)))
+
+	require.Equal(t, []string{
+		"cpu value=1 0\n",
+		"cpu value=2 0\n",
+		"cpu value=3 0\n",
+	}, received)
+
+	files, err = filepath.Glob(filepath.Join(dir, "*.lp"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestWriteReplaysLimitedNumberOfQueuedBatches(t *testing.T) {
+	var mu sync.Mutex
+	var down bool
+	var received []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		received = append(received, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "orangesys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	output := &orangesys.Orangesys{
+		URLs:                 []string{ts.URL},
+		JwtToken:             "jwt_token",
+		SkipDatabaseCreation: true,
+		QueueDir:             dir,
+		QueueReplayBatches:   2,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	newMetric := func(value float64) []telegraf.Metric {
+		m, err := metric.New(
+			"cpu",
+			map[string]string{},
+			map[string]interface{}{
+				"value": value,
+			},
+			time.Unix(0, 0),
+		)
+		require.NoError(t, err)
+		return []telegraf.Metric{m}
+	}
+
+	queued := func() int {
+		files, err := filepath.Glob(filepath.Join(dir, "*.lp"))
+		require.NoError(t, err)
+		return len(files)
+	}
+
+	mu.Lock()
+	down = true
+	mu.Unlock()
+	for value := 1.0; value <= 3; value++ {
+		require.NoError(t, output.Write(newMetric(value)))
+	}
+	require.Equal(t, 3, queued())
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+
+	require.NoError(t, output.Write(newMetric(4)))
+	require.Equal(t, []string{
+		"cpu value=1 0\n",
+		"cpu value=2 0\n",
+	}, received)
+	require.Equal(t, 2, queued())
+
+	require.NoError(t, output.Write(newMetric(5)))
+	require.Equal(t, []string{
+		"cpu value=1 0\n",
+		"cpu value=2 0\n",
+		"cpu value=3 0\n",
+		"cpu value=4 0\n",
+		"cpu value=5 0\n",
+	}, received)
+	require.Equal(t, 0, queued())
+	require.NoError(t, output.Close())
+}
+
+func TestWriteFailsWhenBatchCannotBeQueuedBehindBacklog(t *testing.T) {
+	var mu sync.Mutex
+	down := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "orangesys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	output := &orangesys.Orangesys{
+		URLs:                 []string{ts.URL},
+		JwtToken:             "jwt_token",
+		SkipDatabaseCreation: true,
+		QueueDir:             dir,
+		QueueMaxBytes:        40,
+		QueueEviction:        "drop_newest",
+		QueueReplayBatches:   1,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	newMetrics := func(n int) []telegraf.Metric {
+		var metrics []telegraf.Metric
+		for value := 0; value < n; value++ {
+			m, err := metric.New(
+				"cpu",
+				map[string]string{},
+				map[string]interface{}{
+					"value": float64(value),
+				},
+				time.Unix(0, 0),
+			)
+			require.NoError(t, err)
+			metrics = append(metrics, m)
+		}
+		return metrics
+	}
+
+	require.NoError(t, output.Write(newMetrics(1)))
+	require.NoError(t, output.Write(newMetrics(1)))
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+
+	err = output.Write(newMetrics(3))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "disk queue is full")
+	require.NoError(t, output.Close())
+}
+
+func TestWriteKeepsQueuedBatchesWhileCircuitBreakerIsOpen(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "orangesys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	output := &orangesys.Orangesys{
+		URLs:                           []string{ts.URL},
+		JwtToken:                       "jwt_token",
+		SkipDatabaseCreation:           true,
+		QueueDir:                       dir,
+		CircuitBreakerFailureThreshold: 1,
+		CircuitBreakerCooldown:         internal.Duration{Duration: time.Hour},
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	require.NoError(t, output.Write(testMetrics(t)))
+	require.NoError(t, output.Write(testMetrics(t)))
+	require.NoError(t, output.Close())
+	require.Equal(t, 1, requests)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.lp"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+}
+
+func TestWriteStoresRejectedMetricsInDeadLetterFiles(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"partial write: field type conflict: input field \"value\" on measurement \"cpu\" is type integer, already exists as type float dropped=1"}`))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "orangesys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	output := &orangesys.Orangesys{
+		URLs:                 []string{ts.URL},
+		Database:             "telegraf",
+		JwtToken:             "jwt_token",
+		SkipDatabaseCreation: true,
+		DeadLetterDir:        dir,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	var metrics []telegraf.Metric
+	for _, value := range []interface{}{int64(42), 42.0} {
+		m, err := metric.New(
+			"cpu",
+			map[string]string{},
+			map[string]interface{}{
+				"value": value,
+			},
+			time.Unix(0, 0),
+		)
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	require.NoError(t, output.Write(metrics))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.lp"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	lines, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	require.Equal(t, "cpu value=42i 0\n", string(lines))
+
+	sidecar, err := ioutil.ReadFile(strings.TrimSuffix(files[0], ".lp") + ".json")
+	require.NoError(t, err)
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(sidecar, &record))
+	require.Equal(t, ts.URL, record["endpoint"])
+	require.Equal(t, "telegraf", record["database"])
+	require.Equal(t, float64(http.StatusBadRequest), record["status"])
+	require.Equal(t, "field type conflict on cpu.value", record["reason"])
+}
+
+func TestCloseCancelsInFlightWritesAfterShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	output := &orangesys.Orangesys{
+		URLs:                 []string{ts.URL},
+		JwtToken:             "jwt_token",
+		SkipDatabaseCreation: true,
+		Timeout:              internal.Duration{Duration: time.Minute},
+		ShutdownTimeout:      internal.Duration{Duration: 50 * time.Millisecond},
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	m, err := metric.New(
+		"cpu",
+		map[string]string{},
+		map[string]interface{}{
+			"value": 42.0,
+		},
+		time.Unix(0, 0),
+	)
+	require.NoError(t, err)
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- output.Write([]telegraf.Metric{m})
+	}()
+	<-started
+
+	start := time.Now()
+	require.NoError(t, output.Close())
+	require.True(t, time.Since(start) < 10*time.Second)
+	require.Error(t, <-errC)
+}
+
+func TestWriteSendsSameBatchIDOnRetryAndFailover(t *testing.T) {
+	var mu sync.Mutex
+	var ids []string
+	var requests int
+	handler := func(fail func() bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			ids = append(ids, r.Header.Get("Idempotency-Key"))
+			if fail() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	down := httptest.NewServer(handler(func() bool { return true }))
+	defer down.Close()
+	flapping := httptest.NewServer(handler(func() bool {
+		requests++
+		return requests == 1
+	}))
+	defer flapping.Close()
+
+	output := orangesys.Orangesys{
+		URLs:                 []string{down.URL, flapping.URL},
+		JwtToken:             "jwt_token",
+		SkipDatabaseCreation: true,
+		BatchIDHeader:        "Idempotency-Key",
+		RetryMaxAttempts:     3,
+		RetryInitialInterval: internal.Duration{Duration: time.Millisecond},
+		RetryMaxInterval:     internal.Duration{Duration: 10 * time.Millisecond},
+		RetryMaxElapsedTime:  internal.Duration{Duration: time.Second},
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	require.NoError(t, output.Write(testMetrics(t)))
+	require.True(t, len(ids) >= 2)
+	for _, id := range ids {
+		require.NotEmpty(t, id)
+		require.Equal(t, ids[0], id)
+	}
+	first := ids[0]
+
+	m, err := metric.New(
+		"mem",
+		map[string]string{},
+		map[string]interface{}{
+			"value": 42.0,
+		},
+		time.Unix(0, 0),
+	)
+	require.NoError(t, err)
+
+	ids = nil
+	require.NoError(t, output.Write([]telegraf.Metric{m}))
+	require.NotEqual(t, first, ids[len(ids)-1])
+}
+
+func TestWriteStrategies(t *testing.T) {
+	urls := []string{"http://a:8086", "http://b:8086", "http://c:8086"}
+
+	tests := []struct {
+		name     string
+		strategy string
+		quorum   int
+		down     map[string]bool
+		writes   int
+		expected []string
+		err      bool
+	}{
+		{
+			name:     "round robin",
+			strategy: "round_robin",
+			writes:   4,
+			expected: []string{"http://a:8086", "http://b:8086", "http://c:8086", "http://a:8086"},
+		},
+		{
+			name:     "failover uses primary",
+			strategy: "failover",
+			writes:   2,
+			expected: []string{"http://a:8086", "http://a:8086"},
+		},
+		{
+			name:     "failover to secondary",
+			strategy: "failover",
+			down:     map[string]bool{"http://a:8086": true},
+			writes:   1,
+			expected: []string{"http://a:8086", "http://b:8086"},
+		},
+		{
+			name:     "broadcast",
+			strategy: "broadcast",
+			writes:   1,
+			expected: []string{"http://a:8086", "http://b:8086", "http://c:8086"},
+		},
+		{
+			name:     "broadcast reaches quorum",
+			strategy: "broadcast",
+			quorum:   2,
+			down:     map[string]bool{"http://c:8086": true},
+			writes:   1,
+			expected: []string{"http://a:8086", "http://b:8086", "http://c:8086"},
+		},
+		{
+			name:     "broadcast misses quorum",
+			strategy: "broadcast",
+			down:     map[string]bool{"http://c:8086": true},
+			writes:   1,
+			expected: []string{"http://a:8086", "http://b:8086", "http://c:8086"},
+			err:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var written []string
+			output := orangesys.Orangesys{
+				URLs:                 urls,
+				SkipDatabaseCreation: true,
+				WriteStrategy:        tt.strategy,
+				WriteQuorum:          tt.quorum,
+				CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+					u := config.URL.String()
+					return &MockClient{
+						URLF: func() string {
+							return u
+						},
+						WriteF: func(ctx context.Context, metrics []telegraf.Metric) error {
+							mu.Lock()
+							written = append(written, u)
+							mu.Unlock()
+							if tt.down[u] {
+								return errors.New("connection refused")
+							}
+							return nil
+						},
+					}, nil
+				},
+			}
+			require.NoError(t, output.Connect())
+
+			for n := 0; n < tt.writes; n++ {
+				err := output.Write(testMetrics(t))
+				if tt.err {
+					require.Error(t, err)
+				} else {
+					require.NoError(t, err)
+				}
+			}
+
+			if tt.strategy == "broadcast" {
+				sort.Strings(written)
+			}
+			require.Equal(t, tt.expected, written)
+		})
+	}
+}
+
+func TestWriteBroadcastSendsSameBodyToEveryServer(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	var urls []string
+	for n := 0; n < 4; n++ {
+		ts := httptest.NewServer(handler)
+		defer ts.Close()
+		urls = append(urls, ts.URL)
+	}
+
+	output := orangesys.Orangesys{
+		URLs:                 urls,
+		JwtToken:             "jwt_token",
+		WriteStrategy:        "broadcast",
+		SkipDatabaseCreation: true,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	var metrics []telegraf.Metric
+	for n := 0; n < 100; n++ {
+		m, err := metric.New(
+			"cpu",
+			map[string]string{"host": fmt.Sprintf("host%d", n)},
+			map[string]interface{}{
+				"value": float64(n),
+			},
+			time.Unix(0, 0),
+		)
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+
+	require.NoError(t, output.Write(metrics))
+	require.Len(t, bodies, len(urls))
+	for _, body := range bodies[1:] {
+		require.Equal(t, bodies[0], body)
+	}
+}
+
+func TestConnectRejectsInvalidWriteStrategy(t *testing.T) {
+	for _, output := range []*orangesys.Orangesys{
+		{WriteStrategy: "fastest"},
+		{WriteStrategy: "broadcast", WriteQuorum: 2},
+	} {
+		output.SkipDatabaseCreation = true
+		output.CreateHTTPClientF = func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return &MockClient{}, nil
+		}
+		require.Error(t, output.Connect())
+	}
+}
+
+func TestWriteWeightedStrategyPrefersWeightAndLatency(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]float64
+		delay   map[string]time.Duration
+	}{
+		{
+			name:    "weight",
+			weights: map[string]float64{"http://near:8086": 10, "http://far:8086": 1},
+		},
+		{
+			name:  "latency",
+			delay: map[string]time.Duration{"http://far:8086": 10 * time.Millisecond},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writes := map[string]int{}
+			output := orangesys.Orangesys{
+				URLs:                 []string{"http://near:8086", "http://far:8086"},
+				SkipDatabaseCreation: true,
+				WriteStrategy:        "weighted",
+				URLWeights:           tt.weights,
+				CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+					u := config.URL.String()
+					return &MockClient{
+						URLF: func() string {
+							return u
+						},
+						WriteF: func(ctx context.Context, metrics []telegraf.Metric) error {
+							writes[u]++
+							time.Sleep(tt.delay[u])
+							return nil
+						},
+					}, nil
+				},
+			}
+			require.NoError(t, output.Connect())
+
+			for n := 0; n < 200; n++ {
+				require.NoError(t, output.Write(testMetrics(t)))
+			}
+			require.True(t, writes["http://near:8086"] > 3*writes["http://far:8086"],
+				"near: %d, far: %d", writes["http://near:8086"], writes["http://far:8086"])
+		})
+	}
+}
+
+func TestWriteShardStrategyKeepsSeriesOnOneServer(t *testing.T) {
+	urls := []string{"http://a:8086", "http://b:8086", "http://c:8086"}
+
+	var metrics []telegraf.Metric
+	for n := 0; n < 50; n++ {
+		m, err := metric.New(
+			"cpu",
+			map[string]string{"host": fmt.Sprintf("host%d", n)},
+			map[string]interface{}{
+				"value": 42.0,
+			},
+			time.Unix(0, 0),
+		)
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+
+	write := func(down string) map[string]string {
+		owners := map[string]string{}
+		output := orangesys.Orangesys{
+			URLs:                 urls,
+			SkipDatabaseCreation: true,
+			WriteStrategy:        "shard",
+			ShardTags:            []string{"host"},
+			CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+				u := config.URL.String()
+				return &MockClient{
+					URLF: func() string {
+						return u
+					},
+					WriteF: func(ctx context.Context, metrics []telegraf.Metric) error {
+						if u == down {
+							return errors.New("connection refused")
+						}
+						for _, m := range metrics {
+							host, _ := m.GetTag("host")
+							owners[host] = u
+						}
+						return nil
+					},
+				}, nil
+			},
+		}
+		require.NoError(t, output.Connect())
+		require.NoError(t, output.Write(metrics))
+		require.Len(t, owners, len(metrics))
+		return owners
+	}
+
+	owners := write("")
+	require.Equal(t, owners, write(""))
+
+	servers := map[string]bool{}
+	for _, u := range owners {
+		servers[u] = true
+	}
+	require.Len(t, servers, len(urls))
+
+	failover := write("http://b:8086")
+	for host, u := range owners {
+		if u == "http://b:8086" {
+			require.NotEqual(t, "http://b:8086", failover[host])
+		} else {
+			require.Equal(t, u, failover[host])
+		}
+	}
+}
+
+func TestWriteRoutesMetricsToDatabases(t *testing.T) {
+	var mu sync.Mutex
+	writes := map[string][]string{}
+	var queries []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/query":
+			require.NoError(t, r.ParseForm())
+			queries = append(queries, r.Form.Get("q"))
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"results":[{}]}`))
+		case "/write":
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			db := r.URL.Query().Get("db")
+			writes[db] = append(writes[db], string(body))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	output := orangesys.Orangesys{
+		URLs:               []string{ts.URL},
+		JwtToken:           "jwt_token",
+		DatabaseTag:        "team",
+		ExcludeDatabaseTag: true,
+		DatabaseRules: []*orangesys.DatabaseRule{
+			{Measurement: "^mem", Database: "memory"},
+		},
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	newMetric := func(name string, tags map[string]string) telegraf.Metric {
+		m, err := metric.New(
+			name,
+			tags,
+			map[string]interface{}{
+				"value": 42.0,
+			},
+			time.Unix(0, 0),
+		)
+		require.NoError(t, err)
+		return m
+	}
+	metrics := []telegraf.Metric{
+		newMetric("cpu", map[string]string{"team": "team_a"}),
+		newMetric("mem", map[string]string{}),
+		newMetric("mem", map[string]string{"team": "team_a"}),
+		newMetric("disk", map[string]string{}),
+	}
+
+	require.NoError(t, output.Write(metrics))
+	require.NoError(t, output.Write(metrics))
+
+	require.Equal(t, map[string][]string{
+		"team_a":   {"cpu value=42 0\nmem value=42 0\n", "cpu value=42 0\nmem value=42 0\n"},
+		"memory":   {"mem value=42 0\n", "mem value=42 0\n"},
+		"telegraf": {"disk value=42 0\n", "disk value=42 0\n"},
+	}, writes)
+	require.Equal(t, []string{
+		`CREATE DATABASE "telegraf"`,
+		`CREATE DATABASE "team_a"`,
+		`CREATE DATABASE "memory"`,
+	}, queries)
+}
+
+func TestWriteRecreatesRoutedDatabaseIfDatabaseNotFound(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	missing := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/query":
+			require.NoError(t, r.ParseForm())
+			queries = append(queries, r.Form.Get("q"))
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"results":[{}]}`))
+		case "/write":
+			if missing {
+				missing = false
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":"database not found: \"team_a\""}`))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	output := orangesys.Orangesys{
+		URLs:                           []string{ts.URL},
+		JwtToken:                       "jwt_token",
+		DatabaseTag:                    "team",
+		CircuitBreakerFailureThreshold: 5,
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	m, err := metric.New("cpu", map[string]string{"team": "team_a"},
+		map[string]interface{}{"value": 42.0}, time.Unix(0, 0))
+	require.NoError(t, err)
+
+	require.Error(t, output.Write([]telegraf.Metric{m}))
+	require.Equal(t, []string{
+		`CREATE DATABASE "telegraf"`,
+		`CREATE DATABASE "team_a"`,
+		`CREATE DATABASE "team_a"`,
+	}, queries)
+}
+
+func TestConnectRejectsInvalidDatabaseRule(t *testing.T) {
+	output := orangesys.Orangesys{
+		DatabaseRules: []*orangesys.DatabaseRule{
+			{Measurement: "(", Database: "broken"},
+		},
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return &MockClient{}, nil
+		},
+	}
+	require.Error(t, output.Connect())
+}
+
+func TestWriteRoutesMetricsToRetentionPolicies(t *testing.T) {
+	var mu sync.Mutex
+	writes := map[string][]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		q := r.URL.Query()
+		key := q.Get("db") + "/" + q.Get("rp")
+		writes[key] = append(writes[key], string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	output := orangesys.Orangesys{
+		URLs:                      []string{ts.URL},
+		JwtToken:                  "jwt_token",
+		SkipDatabaseCreation:      true,
+		RetentionPolicy:           "default",
+		DatabaseTag:               "team",
+		RetentionPolicyTag:        "rp",
+		ExcludeRetentionPolicyTag: true,
+		RetentionPolicyRules: []*orangesys.RetentionPolicyRule{
+			{Measurement: "^(cpu|mem)$", RetentionPolicy: "7d"},
+		},
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			return orangesys.NewHTTPClient(config)
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	newMetric := func(name string, tags map[string]string) telegraf.Metric {
+		m, err := metric.New(
+			name,
+			tags,
+			map[string]interface{}{
+				"value": 42.0,
+			},
+			time.Unix(0, 0),
+		)
+		require.NoError(t, err)
+		return m
+	}
+
+	require.NoError(t, output.Write([]telegraf.Metric{
+		newMetric("cpu", map[string]string{}),
+		newMetric("revenue", map[string]string{"rp": "2y"}),
+		newMetric("mem", map[string]string{"team": "team_a"}),
+		newMetric("cpu", map[string]string{"team": "team_a", "rp": "2y"}),
+		newMetric("disk", map[string]string{}),
+	}))
+
+	require.Equal(t, map[string][]string{
+		"telegraf/7d":      {"cpu value=42 0\n"},
+		"telegraf/2y":      {"revenue value=42 0\n"},
+		"team_a/7d":        {"mem,team=team_a value=42 0\n"},
+		"team_a/2y":        {"cpu,team=team_a value=42 0\n"},
+		"telegraf/default": {"disk value=42 0\n"},
+	}, writes)
+}
+
+func TestWriteDiscoversEndpointsFromSRVRecords(t *testing.T) {
+	var mu sync.Mutex
+	var lookupErr error
+	var names []string
+	records := []*net.SRV{
+		{Target: "b.example.internal.", Port: 8086, Priority: 20, Weight: 10},
+		{Target: "a.example.internal.", Port: 8086, Priority: 10, Weight: 10},
+	}
+	down := map[string]bool{}
+	closed := map[string]bool{}
+	var written []string
+
+	output := orangesys.Orangesys{
+		URLs:                 []string{"srv+https://_orangesys._tcp.example.internal/prefix"},
+		SkipDatabaseCreation: true,
+		SRVRefreshInterval:   internal.Duration{Duration: 10 * time.Millisecond},
+		LookupSRVF: func(ctx context.Context, name string) ([]*net.SRV, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			names = append(names, name)
+			return append([]*net.SRV(nil), records...), lookupErr
+		},
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			u := config.URL.String()
+			return &MockClient{
+				URLF: func() string {
+					return u
+				},
+				WriteF: func(ctx context.Context, metrics []telegraf.Metric) error {
+					mu.Lock()
+					defer mu.Unlock()
+					if down[u] {
+						return errors.New("connection refused")
+					}
+					written = append(written, u)
+					return nil
+				},
+				CloseIdleConnectionsF: func() {
+					mu.Lock()
+					defer mu.Unlock()
+					closed[u] = true
+				},
+			}, nil
+		},
+	}
+	require.NoError(t, output.Connect())
+	defer output.Close()
+	mu.Lock()
+	require.Equal(t, "_orangesys._tcp.example.internal", names[0])
+	mu.Unlock()
+
+	m, err := metric.New(
+		"cpu",
+		map[string]string{},
+		map[string]interface{}{
+			"value": 42.0,
+		},
+		time.Unix(0, 0),
+	)
+	require.NoError(t, err)
+
+	lastWrite := func() string {
+		require.NoError(t, output.Write([]telegraf.Metric{m}))
+		mu.Lock()
+		defer mu.Unlock()
+		return written[len(written)-1]
+	}
+
+	// The record with the lowest priority number is used first.
+	require.Equal(t, "https://a.example.internal:8086/prefix", lastWrite())
+
+	mu.Lock()
+	down["https://a.example.internal:8086/prefix"] = true
+	mu.Unlock()
+	require.Equal(t, "https://b.example.internal:8086/prefix", lastWrite())
+
+	// a is replaced by c, which takes over as the primary.
+	mu.Lock()
+	records = []*net.SRV{
+		{Target: "b.example.internal.", Port: 8086, Priority: 20, Weight: 10},
+		{Target: "c.example.internal.", Port: 8087, Priority: 5, Weight: 10},
+	}
+	mu.Unlock()
+	require.Eventually(t, func() bool {
+		return lastWrite() == "https://c.example.internal:8087/prefix"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	require.True(t, closed["https://a.example.internal:8086/prefix"])
+	require.False(t, closed["https://b.example.internal:8086/prefix"])
+
+	// Lookup failures keep the servers found before.
+	lookupErr = errors.New("no such host")
+	mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, "https://c.example.internal:8087/prefix", lastWrite())
+}
+
+func TestWriteSpreadsByWeightOfSRVRecords(t *testing.T) {
+	written := map[string]int{}
+	output := orangesys.Orangesys{
+		URLs:                 []string{"srv+https://_orangesys._tcp.example.internal"},
+		SkipDatabaseCreation: true,
+		LookupSRVF: func(ctx context.Context, name string) ([]*net.SRV, error) {
+			return []*net.SRV{
+				{Target: "a.example.internal.", Port: 8086, Priority: 10, Weight: 90},
+				{Target: "b.example.internal.", Port: 8086, Priority: 10, Weight: 10},
+			}, nil
+		},
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			u := config.URL.String()
+			return &MockClient{
+				URLF: func() string {
+					return u
+				},
+				WriteF: func(ctx context.Context, metrics []telegraf.Metric) error {
+					written[u]++
+					return nil
+				},
+				CloseIdleConnectionsF: func() {},
+			}, nil
+		},
+	}
+	require.NoError(t, output.Connect())
+	defer output.Close()
+
+	for n := 0; n < 1000; n++ {
+		require.NoError(t, output.Write(testMetrics(t)))
+	}
+	require.True(t, written["https://a.example.internal:8086"] > 700, "written: %v", written)
+	require.True(t, written["https://b.example.internal:8086"] > 0, "written: %v", written)
+}
+
+func TestWriteWhileSRVRecordsChange(t *testing.T) {
+	var lookups uint32
+	output := orangesys.Orangesys{
+		Endpoints: []*orangesys.Endpoint{
+			{
+				URL:      "srv+https://_orangesys._tcp.example.internal",
+				JwtToken: makeTestJWT(t, map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()}),
+			},
+		},
+		SkipDatabaseCreation: true,
+		SRVRefreshInterval:   internal.Duration{Duration: time.Millisecond},
+		LookupSRVF: func(ctx context.Context, name string) ([]*net.SRV, error) {
+			port := uint16(8000 + atomic.AddUint32(&lookups, 1)%100)
+			return []*net.SRV{{Target: "a.example.internal.", Port: port}}, nil
+		},
+		CreateHTTPClientF: func(config *orangesys.HTTPConfig) (orangesys.Client, error) {
+			u := config.URL.String()
+			return &MockClient{
+				URLF: func() string {
+					return u
+				},
+				WriteF: func(ctx context.Context, metrics []telegraf.Metric) error {
+					return nil
+				},
+				CloseIdleConnectionsF: func() {},
+			}, nil
+		},
+	}
+	require.NoError(t, output.Connect())
+
+	for atomic.LoadUint32(&lookups) < 50 {
+		require.NoError(t, output.Write(testMetrics(t)))
+	}
+	require.NoError(t, output.Close())
 }
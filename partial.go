@@ -0,0 +1,210 @@
+package orangesys
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/influxdata/telegraf"
+)
+
+var (
+	droppedRe           = regexp.MustCompile(`dropped=(\d+)`)
+	fieldTypeConflictRe = regexp.MustCompile(`input field "([^"]+)" on measurement "([^"]+)" is type (\w+), already exists as type (\w+)`)
+	maxValuesPerTagRe   = regexp.MustCompile(`max-values-per-tag limit exceeded[^:]*: measurement="([^"]+)" tag="([^"]+)" value="([^"]*)"`)
+)
+
+// RejectedMetric is a metric that the server discarded.
+type RejectedMetric struct {
+	Metric          telegraf.Metric
+	Reason          string
+	Database        string
+	RetentionPolicy string
+}
+
+// PartialWriteError is returned when the server accepted only part of a
+// batch.  Retrying the rejected metrics would not succeed, so the write as
+// a whole counts as done.
+type PartialWriteError struct {
+	URL        string
+	StatusCode int
+	Accepted   int
+	Rejected   []RejectedMetric
+
+	// Unidentified is the number of metrics the server reported as
+	// dropped that could not be matched to a metric of the batch.
+	Unidentified int
+}
+
+// RejectedCount returns the number of metrics discarded by the server.
+func (e *PartialWriteError) RejectedCount() int {
+	return len(e.Rejected) + e.Unidentified
+}
+
+func (e *PartialWriteError) Error() string {
+	counts := map[string]int{}
+	for _, r := range e.Rejected {
+		counts[r.Reason]++
+	}
+	reasons := make([]string, 0, len(counts))
+	for reason, n := range counts {
+		reasons = append(reasons, fmt.Sprintf("%d %s", n, reason))
+	}
+	sort.Strings(reasons)
+	if e.Unidentified > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d unidentified", e.Unidentified))
+	}
+
+	return fmt.Sprintf("partial write to [%s]: %d metrics accepted, %d rejected (%s)",
+		e.URL, e.Accepted, e.RejectedCount(), strings.Join(reasons, ", "))
+}
+
+// merge adds the results of another part of the same batch.
+func (e *PartialWriteError) merge(other *PartialWriteError) {
+	e.Accepted += other.Accepted
+	e.Rejected = append(e.Rejected, other.Rejected...)
+	e.Unidentified += other.Unidentified
+	if e.StatusCode == 0 {
+		e.StatusCode = other.StatusCode
+	}
+}
+
+// partialWriteError maps the rejections described in the error body of the
+// server back to the metrics of the batch.
+func (c *httpClient) partialWriteError(metrics []telegraf.Metric, statusCode int, desc string) *PartialWriteError {
+	rejected := make(map[int]string)
+
+	// Each line that could not be parsed is quoted in the error.
+	var lines map[string]int
+	for _, part := range strings.Split(desc, "\n") {
+		start := strings.Index(part, errStringUnableToParse+" '")
+		end := strings.LastIndex(part, "': ")
+		if start < 0 || end < start+len(errStringUnableToParse)+2 {
+			continue
+		}
+		if lines == nil {
+			lines = c.serializedLines(metrics)
+		}
+
+		line := part[start+len(errStringUnableToParse)+2 : end]
+		if n, ok := lines[line]; ok {
+			rejected[n] = errStringUnableToParse + ": " + part[end+3:]
+		}
+	}
+
+	for _, match := range fieldTypeConflictRe.FindAllStringSubmatch(desc, -1) {
+		field, measurement, fieldType := match[1], match[2], match[3]
+		for n, m := range metrics {
+			if m.Name() != measurement {
+				continue
+			}
+			if v, ok := m.GetField(field); ok && influxFieldType(v) == fieldType {
+				rejected[n] = fmt.Sprintf("field type conflict on %s.%s", measurement, field)
+			}
+		}
+	}
+
+	for _, match := range maxValuesPerTagRe.FindAllStringSubmatch(desc, -1) {
+		measurement, tag, value := match[1], match[2], match[3]
+		for n, m := range metrics {
+			if v, ok := m.GetTag(tag); ok && m.Name() == measurement && v == value {
+				rejected[n] = fmt.Sprintf("max-values-per-tag limit exceeded on %s.%s", measurement, tag)
+			}
+		}
+	}
+
+	dropped := -1
+	if match := droppedRe.FindStringSubmatch(desc); match != nil {
+		dropped, _ = strconv.Atoi(match[1])
+	}
+
+	// The points beyond the retention policy are the oldest ones.
+	if strings.Contains(desc, errStringPointsBeyondRP) && dropped > len(rejected) {
+		order := make([]int, 0, len(metrics))
+		for n := range metrics {
+			if _, ok := rejected[n]; !ok {
+				order = append(order, n)
+			}
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return metrics[order[a]].Time().Before(metrics[order[b]].Time())
+		})
+		// The count comes from the server, the rest is reported as
+		// unidentified.
+		count := dropped - len(rejected)
+		if count > len(order) {
+			count = len(order)
+		}
+		for _, n := range order[:count] {
+			rejected[n] = errStringPointsBeyondRP
+		}
+	}
+
+	result := &PartialWriteError{
+		URL:        c.URL(),
+		StatusCode: statusCode,
+	}
+
+	indexes := make([]int, 0, len(rejected))
+	for n := range rejected {
+		indexes = append(indexes, n)
+	}
+	sort.Ints(indexes)
+	for _, n := range indexes {
+		result.Rejected = append(result.Rejected, RejectedMetric{
+			Metric: metrics[n],
+			Reason: rejected[n],
+		})
+	}
+
+	if dropped > len(rejected) {
+		result.Unidentified = dropped - len(rejected)
+	}
+	if result.RejectedCount() == 0 {
+		// Nothing could be attributed, report the whole description.
+		result.Unidentified = len(metrics)
+		if dropped >= 0 {
+			result.Unidentified = dropped
+		}
+	}
+
+	result.Accepted = len(metrics) - result.RejectedCount()
+	if result.Accepted < 0 {
+		result.Accepted = 0
+	}
+	return result
+}
+
+// serializedLines returns the index of each metric by its line protocol.
+func (c *httpClient) serializedLines(metrics []telegraf.Metric) map[string]int {
+	lines := make(map[string]int, len(metrics))
+	for n, m := range metrics {
+		b, err := c.serializer.Serialize(m)
+		if err != nil {
+			continue
+		}
+		lines[strings.TrimRight(string(b), "\n")] = n
+	}
+	return lines
+}
+
+// influxFieldType returns the name InfluxDB uses for the type of a field
+// value.
+func influxFieldType(v interface{}) string {
+	switch v.(type) {
+	case float64:
+		return "float"
+	case int64:
+		return "integer"
+	case uint64:
+		return "unsigned"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,358 @@
+package orangesys
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/plugins/parsers/influx"
+)
+
+const (
+	defaultQueueMaxBytes      = 1 << 30
+	defaultQueueReplayBatches = 10
+
+	queueEvictOldest = "drop_oldest"
+	queueEvictNewest = "drop_newest"
+
+	queueFsyncAlways = "always"
+	queueFsyncNever  = "never"
+
+	queueSegmentExt = ".lp"
+)
+
+// ErrQueueFull is returned when a batch can not be queued because the
+// queue is full and the eviction policy drops new batches.
+var ErrQueueFull = errors.New("disk queue is full")
+
+// diskQueue persists batches that could not be written as line protocol
+// segment files, one per batch, so they survive restarts.  Segments are
+// named after a sequence number and replayed in order.
+type diskQueue struct {
+	dir      string
+	maxBytes int64
+	eviction string
+	fsync    bool
+
+	mu       sync.Mutex
+	segments []queueSegment
+	size     int64
+	nextSeq  uint64
+}
+
+type queueSegment struct {
+	seq  uint64
+	size int64
+}
+
+func openDiskQueue(dir string, maxBytes int64, eviction, fsync string) (*diskQueue, error) {
+	switch eviction {
+	case "":
+		eviction = queueEvictOldest
+	case queueEvictOldest, queueEvictNewest:
+	default:
+		return nil, fmt.Errorf("unsupported queue_eviction %q", eviction)
+	}
+
+	switch fsync {
+	case "", queueFsyncAlways, queueFsyncNever:
+	default:
+		return nil, fmt.Errorf("unsupported queue_fsync %q", fsync)
+	}
+
+	if maxBytes <= 0 {
+		maxBytes = defaultQueueMaxBytes
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating queue_dir: %v", err)
+	}
+
+	q := &diskQueue{
+		dir:      dir,
+		maxBytes: maxBytes,
+		eviction: eviction,
+		fsync:    fsync != queueFsyncNever,
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading queue_dir: %v", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		// Left behind by a crash while writing a segment.
+		if strings.HasSuffix(name, queueSegmentExt+".tmp") {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, queueSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, queueSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, queueSegment{seq: seq, size: entry.Size()})
+		q.size += entry.Size()
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(q.segments, func(a, b int) bool {
+		return q.segments[a].seq < q.segments[b].seq
+	})
+
+	return q, nil
+}
+
+func (q *diskQueue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, queueSegmentExt))
+}
+
+// Len returns the number of queued batches.
+func (q *diskQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.segments)
+}
+
+// Push appends a batch, evicting the oldest batches if needed to stay
+// within the maximum size.  With the drop_newest policy ErrQueueFull is
+// returned instead.
+func (q *diskQueue) Push(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	size := int64(len(data))
+	if size > q.maxBytes {
+		return ErrQueueFull
+	}
+
+	for q.size+size > q.maxBytes {
+		if q.eviction == queueEvictNewest {
+			return ErrQueueFull
+		}
+
+		oldest := q.segments[0]
+		if err := q.remove(oldest); err != nil {
+			return err
+		}
+		log.Printf("W! [outputs.orangesys] disk queue is full, dropped oldest batch of %d bytes", oldest.size)
+	}
+
+	seq := q.nextSeq
+	if err := q.writeSegment(seq, data); err != nil {
+		return err
+	}
+
+	q.nextSeq++
+	q.segments = append(q.segments, queueSegment{seq: seq, size: size})
+	q.size += size
+	return nil
+}
+
+// writeSegment writes the segment to a temporary file first, so that a
+// crash never leaves a partial segment behind.
+func (q *diskQueue) writeSegment(seq uint64, data []byte) error {
+	path := q.path(seq)
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if q.fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if q.fsync {
+		if d, err := os.Open(q.dir); err == nil {
+			d.Sync()
+			d.Close()
+		}
+	}
+	return nil
+}
+
+// Peek returns the oldest batch and its sequence number.
+func (q *diskQueue) Peek() (uint64, []byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.segments) == 0 {
+		return 0, nil, errors.New("disk queue is empty")
+	}
+
+	seg := q.segments[0]
+	data, err := ioutil.ReadFile(q.path(seg.seq))
+	return seg.seq, data, err
+}
+
+// Pop removes the batch with the sequence number if it is the oldest.
+func (q *diskQueue) Pop(seq uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.segments) == 0 || q.segments[0].seq != seq {
+		return nil
+	}
+	return q.remove(q.segments[0])
+}
+
+func (q *diskQueue) remove(seg queueSegment) error {
+	if err := os.Remove(q.path(seg.seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	q.segments = q.segments[1:]
+	q.size -= seg.size
+	return nil
+}
+
+// writeQueued writes the queued batches in order before the new metrics.
+// While the servers are unavailable, or batches are still queued after
+// replaying queue_replay_batches of them, the new metrics are added to the
+// queue instead.
+func (i *Orangesys) writeQueued(ctx context.Context, metrics []telegraf.Metric) error {
+	drained, err := i.replayQueue(ctx)
+	if err != nil {
+		return i.enqueue(metrics, err)
+	}
+	if !drained {
+		return i.enqueue(metrics, nil)
+	}
+
+	errs, err := i.writeWithRetry(ctx, metrics)
+	if err == nil || rejected(errs) {
+		return err
+	}
+	return i.enqueue(metrics, err)
+}
+
+// rejected reports if the servers rejected the metrics themselves, so
+// writing them again would fail as well.  Batches that failed because a
+// circuit breaker is open or the credentials were refused are kept, they
+// can be written once the servers or credentials are back.
+func rejected(errs []error) bool {
+	if len(errs) == 0 {
+		return false
+	}
+	for _, err := range errs {
+		if _, ok := err.(*APIError); !ok || isRetryable(err) {
+			return false
+		}
+	}
+	return true
+}
+
+// replayQueue writes the queued batches, oldest first, until the queue is
+// empty, queue_replay_batches were written or a write fails for another
+// reason than the servers rejecting the batch.  It reports if the queue is
+// empty.  Batches rejected by the servers are dropped.
+//
+// Limiting the batches keeps each write short after a long outage, so
+// Telegraf's buffer does not overflow while the backlog is replayed.
+func (i *Orangesys) replayQueue(ctx context.Context) (bool, error) {
+	limit := i.QueueReplayBatches
+	if limit <= 0 {
+		limit = defaultQueueReplayBatches
+	}
+
+	for n := 0; i.queue.Len() > 0; n++ {
+		if n >= limit {
+			return false, nil
+		}
+
+		seq, data, err := i.queue.Peek()
+		if err != nil {
+			return false, err
+		}
+
+		parser := influx.NewParser(influx.NewMetricHandler())
+		metrics, err := parser.Parse(data)
+		if err != nil {
+			log.Printf("E! [outputs.orangesys] dropping unreadable batch from disk queue: %v", err)
+			if err := i.queue.Pop(seq); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		errs, err := i.writeRound(ctx, metrics)
+		if err != nil {
+			if !rejected(errs) {
+				return false, err
+			}
+			log.Printf("E! [outputs.orangesys] dropping batch of %d metrics from disk queue: %v", len(metrics), err)
+		}
+
+		if err := i.queue.Pop(seq); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// enqueue stores the metrics in the disk queue after a failed write, or
+// behind the batches still queued when writeErr is nil.  An error is only
+// returned if the metrics could not be queued, so Telegraf keeps them.
+func (i *Orangesys) enqueue(metrics []telegraf.Metric, writeErr error) error {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		b, err := i.serializer.Serialize(m)
+		if err != nil {
+			log.Printf("D! [outputs.orangesys] could not serialize metric: %v", err)
+			continue
+		}
+		buf.Write(b)
+	}
+
+	if err := i.queue.Push(buf.Bytes()); err != nil {
+		log.Printf("E! [outputs.orangesys] could not add batch to disk queue: %v", err)
+		if writeErr == nil {
+			return fmt.Errorf("could not add batch to disk queue: %v", err)
+		}
+		return writeErr
+	}
+
+	if writeErr == nil {
+		log.Printf("D! [outputs.orangesys] stored %d metrics in disk queue behind %d batches still to be replayed",
+			len(metrics), i.queue.Len()-1)
+		return nil
+	}
+	log.Printf("W! [outputs.orangesys] write failed, stored %d metrics in disk queue (%d batches queued): %v",
+		len(metrics), i.queue.Len(), writeErr)
+	return nil
+}
@@ -0,0 +1,120 @@
+package orangesys
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetryMaxAttempts     = 3
+	defaultRetryInitialInterval = 500 * time.Millisecond
+	defaultRetryMaxInterval     = 10 * time.Second
+	defaultRetryMaxElapsedTime  = 30 * time.Second
+)
+
+// retryPolicy decides how often and how long to wait before a failed write
+// is attempted again.
+type retryPolicy struct {
+	MaxAttempts     int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	MaxElapsedTime  time.Duration
+}
+
+// backoff returns the delay before the next attempt, doubling the initial
+// interval after each attempt up to the maximum interval.  A random jitter
+// of up to half the delay is subtracted so that agents do not retry in
+// lockstep.
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.InitialInterval
+	for n := 1; n < attempt && delay < p.MaxInterval; n++ {
+		delay *= 2
+	}
+	if delay > p.MaxInterval {
+		delay = p.MaxInterval
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay - time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// isRetryable reports if the write may succeed when attempted again.
+// Network errors, rate limiting and server errors are retryable, requests
+// rejected by the server are not.
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case *APIError:
+		if e.Type == DatabaseNotFound {
+			return true
+		}
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+	case *AuthError, *TokenExpiredError, *CircuitOpenError, *PartialWriteError:
+		return false
+	default:
+		// Errors without a response from the server, such as timeouts
+		// and refused connections.
+		return true
+	}
+}
+
+// anyRetryable reports if any of the errors is retryable.
+func anyRetryable(errs []error) bool {
+	for _, err := range errs {
+		if isRetryable(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfter returns the delay requested by the server for the error, if
+// any.
+func retryAfter(err error) time.Duration {
+	if e, ok := err.(*APIError); ok {
+		return e.RetryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter parses the Retry-After header of 429 and 503 responses,
+// given either in seconds or as an HTTP date.
+func parseRetryAfter(resp *http.Response, now time.Time) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// sleep waits for the duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,175 @@
+package orangesys
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/influxdata/telegraf"
+)
+
+// DatabaseRule writes the measurements matching a regular expression to a
+// database.
+type DatabaseRule struct {
+	Measurement string `toml:"measurement"`
+	Database    string `toml:"database"`
+
+	measurement *regexp.Regexp
+}
+
+// RetentionPolicyRule writes the measurements matching a regular
+// expression to a retention policy.
+type RetentionPolicyRule struct {
+	Measurement     string `toml:"measurement"`
+	RetentionPolicy string `toml:"retention_policy"`
+
+	measurement *regexp.Regexp
+}
+
+// destination is the database and retention policy a metric is written
+// to.
+type destination struct {
+	database        string
+	retentionPolicy string
+}
+
+// compileRoutingRules checks and compiles the database and retention
+// policy rules.
+func (i *Orangesys) compileRoutingRules() error {
+	for _, rule := range i.DatabaseRules {
+		if rule.Database == "" {
+			return fmt.Errorf("database_rule for %q has no database", rule.Measurement)
+		}
+		re, err := regexp.Compile(rule.Measurement)
+		if err != nil {
+			return fmt.Errorf("error compiling database_rule %q: %v", rule.Measurement, err)
+		}
+		rule.measurement = re
+	}
+
+	for _, rule := range i.RetentionPolicyRules {
+		if rule.RetentionPolicy == "" {
+			return fmt.Errorf("retention_policy_rule for %q has no retention_policy", rule.Measurement)
+		}
+		re, err := regexp.Compile(rule.Measurement)
+		if err != nil {
+			return fmt.Errorf("error compiling retention_policy_rule %q: %v", rule.Measurement, err)
+		}
+		rule.measurement = re
+	}
+	return nil
+}
+
+// routed reports if metrics may go to other destinations than the default.
+func (c *httpClient) routed() bool {
+	return c.databaseTag != "" || len(c.databaseRules) > 0 ||
+		c.retentionPolicyTag != "" || len(c.retentionPolicyRules) > 0
+}
+
+func (c *httpClient) defaultDestination() destination {
+	return destination{database: c.database, retentionPolicy: c.retentionPolicy}
+}
+
+// destinationOf returns where the metric is written to.  The database and
+// retention policy each come from their tag, the first matching rule or
+// the default, in that order.
+func (c *httpClient) destinationOf(m telegraf.Metric) destination {
+	dest := c.defaultDestination()
+
+	if db, ok := tagValue(m, c.databaseTag); ok {
+		dest.database = db
+	} else {
+		for _, rule := range c.databaseRules {
+			if rule.measurement != nil && rule.measurement.MatchString(m.Name()) {
+				dest.database = rule.Database
+				break
+			}
+		}
+	}
+
+	if rp, ok := tagValue(m, c.retentionPolicyTag); ok {
+		dest.retentionPolicy = rp
+	} else {
+		for _, rule := range c.retentionPolicyRules {
+			if rule.measurement != nil && rule.measurement.MatchString(m.Name()) {
+				dest.retentionPolicy = rule.RetentionPolicy
+				break
+			}
+		}
+	}
+	return dest
+}
+
+// tagValue returns the value of the tag if the key is set and the metric
+// has the tag with a value.
+func tagValue(m telegraf.Metric, key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	value, ok := m.GetTag(key)
+	return value, ok && value != ""
+}
+
+// groupByDestination splits the metrics by database and retention policy,
+// keeping the order in which the destinations first appear.
+func (c *httpClient) groupByDestination(metrics []telegraf.Metric) ([]destination, map[destination][]telegraf.Metric) {
+	var destinations []destination
+	batches := make(map[destination][]telegraf.Metric)
+	for _, m := range metrics {
+		dest := c.destinationOf(m)
+		if _, ok := batches[dest]; !ok {
+			destinations = append(destinations, dest)
+		}
+
+		m = c.removeRoutingTags(m)
+		batches[dest] = append(batches[dest], m)
+	}
+	return destinations, batches
+}
+
+// removeRoutingTags returns the metric without the database and retention
+// policy tags if they are excluded.
+func (c *httpClient) removeRoutingTags(m telegraf.Metric) telegraf.Metric {
+	var remove []string
+	if c.excludeDatabaseTag && c.databaseTag != "" && m.HasTag(c.databaseTag) {
+		remove = append(remove, c.databaseTag)
+	}
+	if c.excludeRetentionPolicyTag && c.retentionPolicyTag != "" && m.HasTag(c.retentionPolicyTag) {
+		remove = append(remove, c.retentionPolicyTag)
+	}
+	if len(remove) == 0 {
+		return m
+	}
+
+	m = m.Copy()
+	for _, key := range remove {
+		m.RemoveTag(key)
+	}
+	return m
+}
+
+// ensureDatabase creates a database the first time metrics are routed to
+// it.  The default database is created when connecting.
+func (c *httpClient) ensureDatabase(ctx context.Context, db string) {
+	if c.skipDatabaseCreation {
+		return
+	}
+
+	c.mu.Lock()
+	created := c.createdDatabases[db]
+	c.mu.Unlock()
+	if created {
+		return
+	}
+
+	if err := c.CreateDatabaseNamed(ctx, db); err != nil {
+		log.Printf("W! [outputs.orangesys] when writing to [%s]: database %q creation failed: %v",
+			c.URL(), db, err)
+		return
+	}
+
+	c.mu.Lock()
+	c.createdDatabases[db] = true
+	c.mu.Unlock()
+}
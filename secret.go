@@ -0,0 +1,181 @@
+package orangesys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// secretExecTimeout bounds the run time of exec: secret references.
+	secretExecTimeout = 10 * time.Second
+)
+
+// isSecretRef reports if the value refers to a secret stored elsewhere
+// instead of being the literal value.
+func isSecretRef(value string) bool {
+	for _, prefix := range []string{"env:", "file:", "exec:"} {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecret returns the value of a secret reference:
+//
+//	env:NAME       the environment variable NAME
+//	file:/path     the contents of the file
+//	exec:command   the output of the command, split into arguments on spaces
+//
+// Surrounding whitespace is removed from files and command output.  Values
+// that are not references are returned unchanged.
+func resolveSecret(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(ref, "file:"):
+		path := strings.TrimPrefix(ref, "file:")
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("error reading secret file: %v", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	case strings.HasPrefix(ref, "exec:"):
+		args := strings.Fields(strings.TrimPrefix(ref, "exec:"))
+		if len(args) == 0 {
+			return "", errors.New("empty secret command")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+		defer cancel()
+
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+		if err != nil {
+			return "", fmt.Errorf("error running secret command %q: %v", args[0], err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	default:
+		return ref, nil
+	}
+}
+
+// secret is a configuration value that may be a secret reference.  The
+// reference is resolved when the secret is created and again on Refresh.
+type secret struct {
+	ref string
+
+	mu    sync.Mutex
+	value string
+}
+
+func newSecret(ref string) (*secret, error) {
+	value, err := resolveSecret(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &secret{ref: ref, value: value}, nil
+}
+
+// Value returns the resolved value.
+func (s *secret) Value() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.value
+}
+
+// Token returns the resolved value, so a secret can be used as a
+// TokenSource.
+func (s *secret) Token() (string, error) {
+	return s.Value(), nil
+}
+
+// Refresh resolves the reference again.
+func (s *secret) Refresh() error {
+	_, err := s.update()
+	return err
+}
+
+// update resolves the reference again and reports if the value changed.
+func (s *secret) update() (bool, error) {
+	value, err := resolveSecret(s.ref)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := value != s.value
+	s.value = value
+	return changed, nil
+}
+
+// secretAuthenticator sets basic auth and headers from secret references,
+// and resolves them again when the server rejects the credentials.  The
+// next Authenticator, if any, handles the remaining credentials.
+type secretAuthenticator struct {
+	next Authenticator
+
+	username string
+	password *secret
+	headers  map[string]*secret
+}
+
+func (a *secretAuthenticator) Authenticate(req *http.Request) error {
+	if a.password != nil {
+		req.SetBasicAuth(a.username, a.password.Value())
+	}
+
+	for header, value := range a.headers {
+		req.Header.Set(header, value.Value())
+	}
+
+	if a.next != nil {
+		return a.next.Authenticate(req)
+	}
+	return nil
+}
+
+func (a *secretAuthenticator) Unauthorized(resp *http.Response) bool {
+	refreshed := false
+	if a.next != nil {
+		refreshed = a.next.Unauthorized(resp)
+	}
+
+	secrets := make([]*secret, 0, len(a.headers)+1)
+	if a.password != nil {
+		secrets = append(secrets, a.password)
+	}
+	for _, s := range a.headers {
+		secrets = append(secrets, s)
+	}
+
+	// Only retry when a value changed, the same credentials would be
+	// rejected again.
+	for _, s := range secrets {
+		changed, err := s.update()
+		if err != nil {
+			log.Printf("W! [outputs.orangesys] unable to resolve secret: %v", err)
+			continue
+		}
+		if changed {
+			refreshed = true
+		}
+	}
+	return refreshed
+}
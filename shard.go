@@ -0,0 +1,143 @@
+package orangesys
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/influxdata/telegraf"
+)
+
+const (
+	defaultShardVirtualNodes = 128
+)
+
+// hashRing places each client on a ring of hashes at several virtual nodes.
+// A series belongs to the first client at or after its hash.
+type hashRing struct {
+	hashes  []uint64
+	owners  []int
+	clients int
+}
+
+func newHashRing(urls []string, virtualNodes int) *hashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultShardVirtualNodes
+	}
+
+	type node struct {
+		hash  uint64
+		owner int
+	}
+	nodes := make([]node, 0, len(urls)*virtualNodes)
+	for n, u := range urls {
+		for v := 0; v < virtualNodes; v++ {
+			nodes = append(nodes, node{
+				hash:  hashString(u + "#" + strconv.Itoa(v)),
+				owner: n,
+			})
+		}
+	}
+	sort.Slice(nodes, func(a, b int) bool {
+		return nodes[a].hash < nodes[b].hash
+	})
+
+	r := &hashRing{clients: len(urls)}
+	for _, node := range nodes {
+		r.hashes = append(r.hashes, node.hash)
+		r.owners = append(r.owners, node.owner)
+	}
+	return r
+}
+
+// Owners returns the clients in the order they are found on the ring from
+// the hash onwards, the owner of the hash first.
+func (r *hashRing) Owners(hash uint64) []int {
+	start := sort.Search(len(r.hashes), func(n int) bool {
+		return r.hashes[n] >= hash
+	})
+
+	seen := make([]bool, r.clients)
+	owners := make([]int, 0, r.clients)
+	for n := 0; n < len(r.hashes) && len(owners) < r.clients; n++ {
+		owner := r.owners[(start+n)%len(r.hashes)]
+		if !seen[owner] {
+			seen[owner] = true
+			owners = append(owners, owner)
+		}
+	}
+	return owners
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return mix64(h.Sum64())
+}
+
+// mix64 spreads the bits of an FNV hash, whose high bits hardly change for
+// keys that only differ at the end, over the whole ring.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// seriesHash hashes the measurement name and the values of the shard tags.
+func (i *Orangesys) seriesHash(m telegraf.Metric) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(m.Name()))
+	for _, key := range i.ShardTags {
+		value, _ := m.GetTag(key)
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		h.Write([]byte{'='})
+		h.Write([]byte(value))
+	}
+	return mix64(h.Sum64())
+}
+
+// writeSharded splits the metrics into shards by the owners of their
+// series and writes each shard to its owner, falling back to the next
+// clients on the ring.  When any shard fails, the whole batch is retried;
+// the batch ID of each shard lets the servers discard the shards that
+// were already written.
+func (i *Orangesys) writeSharded(ctx context.Context, metrics []telegraf.Metric) ([]error, error) {
+	var keys []string
+	shards := make(map[string][]telegraf.Metric)
+	orders := make(map[string][]int)
+	for _, m := range metrics {
+		owners := i.ring.Owners(i.seriesHash(m))
+		key := fmt.Sprint(owners)
+		if _, ok := shards[key]; !ok {
+			keys = append(keys, key)
+			orders[key] = owners
+		}
+		shards[key] = append(shards[key], m)
+	}
+
+	var errs []error
+	var failed []string
+	for _, key := range keys {
+		order := orders[key]
+		i.preferHealthy(order)
+
+		shardErrs, err := i.writeOrdered(ctx, shards[key], order)
+		if err != nil {
+			errs = append(errs, shardErrs...)
+			failed = append(failed, err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return errs, fmt.Errorf("could not write %d of %d shards: %s",
+			len(failed), len(keys), strings.Join(failed, "; "))
+	}
+	return nil, nil
+}
@@ -0,0 +1,137 @@
+package orangesys
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+const (
+	writeStrategyRandom     = "random"
+	writeStrategyRoundRobin = "round_robin"
+	writeStrategyFailover   = "failover"
+	writeStrategyBroadcast  = "broadcast"
+	writeStrategyWeighted   = "weighted"
+	writeStrategyShard      = "shard"
+)
+
+// checkWriteStrategy validates write_strategy and write_quorum against the
+// number of clients.  The number of discovered clients changes, so the
+// quorum is only checked against it without SRV urls.
+func (i *Orangesys) checkWriteStrategy() error {
+	switch i.WriteStrategy {
+	case "", writeStrategyRandom, writeStrategyRoundRobin, writeStrategyFailover, writeStrategyWeighted:
+	case writeStrategyShard:
+		if i.ShardVirtualNodes < 0 {
+			return fmt.Errorf("shard_virtual_nodes %d must not be negative", i.ShardVirtualNodes)
+		}
+	case writeStrategyBroadcast:
+		if i.WriteQuorum < 0 || !i.discovery && i.WriteQuorum > len(i.clients) {
+			return fmt.Errorf("write_quorum %d must be between 1 and the number of servers (%d)",
+				i.WriteQuorum, len(i.clients))
+		}
+	default:
+		return fmt.Errorf("unsupported write_strategy %q", i.WriteStrategy)
+	}
+	return nil
+}
+
+// writeOrder returns the order in which the clients are tried.  Clients
+// with a lower SRV priority number come first, the random strategy orders
+// clients of the same priority by their SRV weight as RFC 2782 describes.
+// Clients that failed their
+// last health check are moved to the end, so with the failover strategy
+// traffic returns to the primary once it is healthy.
+func (i *Orangesys) writeOrder() []int {
+	var p []int
+	switch i.WriteStrategy {
+	case writeStrategyRoundRobin:
+		start := int(atomic.AddUint32(&i.roundRobin, 1)-1) % len(i.clients)
+		for n := range i.clients {
+			p = append(p, (start+n)%len(i.clients))
+		}
+	case writeStrategyFailover:
+		for n := range i.clients {
+			p = append(p, n)
+		}
+	case writeStrategyWeighted:
+		p = i.weightedOrder()
+	default:
+		p = weightedShuffle(i.srvWeights)
+	}
+
+	sort.SliceStable(p, func(a, b int) bool {
+		return i.priorities[p[a]] < i.priorities[p[b]]
+	})
+	i.preferHealthy(p)
+	return p
+}
+
+// preferHealthy moves the clients that failed their last health check to
+// the end, keeping the order otherwise.
+func (i *Orangesys) preferHealthy(p []int) {
+	if i.health != nil {
+		sort.SliceStable(p, func(a, b int) bool {
+			return i.health.Healthy(i.clients[p[a]]) && !i.health.Healthy(i.clients[p[b]])
+		})
+	}
+}
+
+// writeBroadcast writes the metrics to all clients concurrently.  The write
+// succeeds when at least the quorum of clients succeeded, by default all of
+// them.  When the write is retried it goes to all clients again, the batch
+// ID lets the servers that already have it discard the duplicate.
+func (i *Orangesys) writeBroadcast(ctx context.Context, metrics []telegraf.Metric) ([]error, error) {
+	results := make([]error, len(i.clients))
+
+	var wg sync.WaitGroup
+	for n, client := range i.clients {
+		wg.Add(1)
+		go func(n int, client Client) {
+			defer wg.Done()
+			start := time.Now()
+			results[n] = client.Write(ctx, metrics)
+			i.observe(n, time.Since(start), results[n])
+		}(n, client)
+	}
+	wg.Wait()
+
+	var errs []error
+	succeeded := 0
+	for n, err := range results {
+		client := i.clients[n]
+		switch apiError := err.(type) {
+		case nil:
+			succeeded++
+			continue
+		case *PartialWriteError:
+			i.partialWrite(client, apiError)
+			succeeded++
+			continue
+		case *APIError:
+			i.recreateDatabase(ctx, client, apiError)
+		case *CircuitOpenError:
+			log.Printf("D! [outputs.orangesys]: skipping [%s]: %v", client.URL(), err)
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, err)
+		log.Printf("E! [outputs.orangesys]: when writing to [%s]: %v", client.URL(), err)
+	}
+
+	quorum := i.WriteQuorum
+	if quorum == 0 {
+		quorum = len(i.clients)
+	}
+	if succeeded >= quorum {
+		return nil, nil
+	}
+	return errs, fmt.Errorf("wrote to %d of %d servers, quorum of %d not reached",
+		succeeded, len(i.clients), quorum)
+}
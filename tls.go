@@ -0,0 +1,157 @@
+package orangesys
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// mapLegacyTLSConfig copies the deprecated ssl_* options onto the embedded
+// tls.ClientConfig, which they otherwise shadow.
+func (i *Orangesys) mapLegacyTLSConfig() {
+	legacy := []struct {
+		name   string
+		value  string
+		target *string
+	}{
+		{"ssl_ca", i.SSLCA, &i.ClientConfig.TLSCA},
+		{"ssl_cert", i.SSLCert, &i.ClientConfig.TLSCert},
+		{"ssl_key", i.SSLKey, &i.ClientConfig.TLSKey},
+	}
+
+	for _, opt := range legacy {
+		if opt.value == "" {
+			continue
+		}
+
+		if *opt.target != "" {
+			log.Printf("W! [outputs.orangesys] %s is deprecated and ignored since tls_%s is set",
+				opt.name, opt.name[len("ssl_"):])
+			continue
+		}
+
+		log.Printf("W! [outputs.orangesys] %s is deprecated, use tls_%s instead",
+			opt.name, opt.name[len("ssl_"):])
+		*opt.target = opt.value
+	}
+
+	if i.InsecureSkipVerify {
+		i.ClientConfig.InsecureSkipVerify = true
+	}
+}
+
+// tlsConfig returns the TLS configuration for a client, applying the CA and
+// server name of the endpoint if it has any.  The client certificate is
+// loaded through GetClientCertificate so that it is reloaded when the files
+// are rotated on disk.
+func (i *Orangesys) tlsConfig(ep *Endpoint) (*tls.Config, error) {
+	clientConfig := i.ClientConfig
+	if ep != nil && ep.TLSCA != "" {
+		clientConfig.TLSCA = ep.TLSCA
+	}
+
+	tlsConfig, err := clientConfig.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if ep != nil && ep.TLSServerName != "" {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.ServerName = ep.TLSServerName
+	}
+
+	if tlsConfig == nil {
+		return nil, nil
+	}
+
+	if clientConfig.TLSCert != "" && clientConfig.TLSKey != "" {
+		reloader, err := newCertReloader(clientConfig.TLSCert, clientConfig.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = nil
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	return tlsConfig, nil
+}
+
+// certReloader holds a client certificate and reloads it when the
+// certificate or key file changes.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	certInfo, keyInfo, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(certInfo, keyInfo); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetClientCertificate returns the current certificate, reloading it first
+// if the files were modified.  When the new files can not be loaded the
+// previous certificate is kept.
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certInfo, keyInfo, err := r.stat()
+	if err != nil {
+		log.Printf("W! [outputs.orangesys] keeping previous client certificate: %v", err)
+		return r.cert, nil
+	}
+
+	if certInfo.ModTime().Equal(r.certModTime) && keyInfo.ModTime().Equal(r.keyModTime) {
+		return r.cert, nil
+	}
+
+	if err := r.load(certInfo, keyInfo); err != nil {
+		log.Printf("W! [outputs.orangesys] keeping previous client certificate: %v", err)
+	}
+	return r.cert, nil
+}
+
+func (r *certReloader) stat() (os.FileInfo, os.FileInfo, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load keypair %s:%s: %v", r.certFile, r.keyFile, err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load keypair %s:%s: %v", r.certFile, r.keyFile, err)
+	}
+	return certInfo, keyInfo, nil
+}
+
+func (r *certReloader) load(certInfo, keyInfo os.FileInfo) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load keypair %s:%s: %v", r.certFile, r.keyFile, err)
+	}
+
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	return nil
+}
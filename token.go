@@ -0,0 +1,99 @@
+package orangesys
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource supplies the bearer token sent with each request.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// staticToken is a token configured directly with jwt_token.
+type staticToken string
+
+func (t staticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// fileToken reads the token from a file and reloads it whenever the file
+// changes on disk, so rotated tokens are picked up without a restart.
+type fileToken struct {
+	path string
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+func newFileToken(path string) (*fileToken, error) {
+	t := &fileToken{path: path}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading jwt_token_file: %v", err)
+	}
+	if err := t.load(info); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Token returns the current token, reloading the file first if it was
+// modified since the last read.  When the new contents can not be read the
+// previous token is kept.
+func (t *fileToken) Token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info, err := os.Stat(t.path)
+	if err != nil {
+		log.Printf("W! [outputs.orangesys] unable to stat jwt_token_file %q, keeping previous token: %v", t.path, err)
+		return t.token, nil
+	}
+
+	if info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return t.token, nil
+	}
+
+	if err := t.load(info); err != nil {
+		log.Printf("W! [outputs.orangesys] unable to reload jwt_token_file %q, keeping previous token: %v", t.path, err)
+	}
+	return t.token, nil
+}
+
+// Refresh rereads the file even if it does not appear to have changed.
+func (t *fileToken) Refresh() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return fmt.Errorf("error reading jwt_token_file: %v", err)
+	}
+	return t.load(info)
+}
+
+func (t *fileToken) load(info os.FileInfo) error {
+	b, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return fmt.Errorf("error reading jwt_token_file: %v", err)
+	}
+
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return fmt.Errorf("jwt_token_file %q is empty", t.path)
+	}
+
+	t.token = token
+	t.modTime = info.ModTime()
+	t.size = info.Size()
+	return nil
+}
@@ -0,0 +1,142 @@
+package orangesys
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// statsAlpha is the weight of a new sample in the moving averages.
+	statsAlpha = 0.3
+)
+
+// endpointStats tracks an exponentially weighted moving average of the
+// write latency and error rate of a client.
+type endpointStats struct {
+	mu        sync.Mutex
+	samples   int
+	latency   float64
+	errorRate float64
+}
+
+// Observe records the outcome of a write.
+func (s *endpointStats) Observe(latency time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	errorSample := 0.0
+	if failed {
+		errorSample = 1
+	}
+
+	if s.samples == 0 {
+		s.latency = latency.Seconds()
+		s.errorRate = errorSample
+	} else {
+		s.latency += statsAlpha * (latency.Seconds() - s.latency)
+		s.errorRate += statsAlpha * (errorSample - s.errorRate)
+	}
+	s.samples++
+}
+
+// Latency returns the average latency and false if there are no samples.
+func (s *endpointStats) Latency() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return time.Duration(s.latency * float64(time.Second)), s.samples > 0
+}
+
+// ErrorRate returns the average error rate between 0 and 1.
+func (s *endpointStats) ErrorRate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.errorRate
+}
+
+// endpointWeight returns the configured weight of the endpoint, 1 if it
+// is not set.
+func (i *Orangesys) endpointWeight(ep *Endpoint) (float64, error) {
+	weight := ep.Weight
+	if weight == 0 {
+		weight = i.URLWeights[ep.URL]
+	}
+	if weight == 0 {
+		weight = 1
+	}
+	if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return 0, fmt.Errorf("invalid weight %v for [%s]", weight, ep.URL)
+	}
+	return weight, nil
+}
+
+// observe records the outcome of a write to the client with index n.
+func (i *Orangesys) observe(n int, latency time.Duration, err error) {
+	if n >= len(i.stats) {
+		return
+	}
+	if _, ok := err.(*CircuitOpenError); ok {
+		return
+	}
+	i.stats[n].Observe(latency, err != nil && isEndpointFailure(err))
+}
+
+// scores returns the score of each client: its weight divided by the
+// average latency and reduced by the error rate.  Clients without samples
+// are scored with the latency of the fastest client, so they are tried.
+func (i *Orangesys) scores() []float64 {
+	fastest := time.Duration(0)
+	latencies := make([]time.Duration, len(i.clients))
+	sampled := make([]bool, len(i.clients))
+	for n := range i.clients {
+		latencies[n], sampled[n] = i.stats[n].Latency()
+		if sampled[n] && (fastest == 0 || latencies[n] < fastest) {
+			fastest = latencies[n]
+		}
+	}
+
+	scores := make([]float64, len(i.clients))
+	for n := range i.clients {
+		latency := latencies[n]
+		if !sampled[n] {
+			latency = fastest
+		}
+		if latency < time.Millisecond {
+			latency = time.Millisecond
+		}
+
+		errorRate := i.stats[n].ErrorRate()
+		scores[n] = i.weights[n] * (1 - 0.9*errorRate) / latency.Seconds()
+	}
+	return scores
+}
+
+// weightedOrder returns the clients in a random order where clients with a
+// higher score are more likely to come first, so that most writes go to
+// the best client while the others still receive some traffic.
+func (i *Orangesys) weightedOrder() []int {
+	return weightedShuffle(i.scores())
+}
+
+// weightedShuffle returns the indexes of the weights in a random order.
+func weightedShuffle(weights []float64) []int {
+	// Weighted random sampling without replacement: sorting by
+	// log(u)/weight picks each index first with a probability
+	// proportional to its weight.
+	keys := make([]float64, len(weights))
+	p := make([]int, len(weights))
+	for n, weight := range weights {
+		p[n] = n
+		keys[n] = math.Log(1-rand.Float64()) / weight
+	}
+
+	sort.SliceStable(p, func(a, b int) bool {
+		return keys[p[a]] > keys[p[b]]
+	})
+	return p
+}